@@ -0,0 +1,511 @@
+package tcmu
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/coreos/go-tcmu/scsi"
+	"github.com/sirupsen/logrus"
+)
+
+const defaultALUAGroup = "default_tg_pt_gp"
+
+// ALUAState is the asymmetric access state of a target port group, as
+// reported to initiators by REPORT TARGET PORT GROUPS.
+type ALUAState byte
+
+const (
+	ALUAActiveOptimized    ALUAState = 0x0
+	ALUAActiveNonOptimized ALUAState = 0x1
+	ALUAStandby            ALUAState = 0x2
+	ALUAUnavailable        ALUAState = 0x3
+	ALUATransitioning      ALUAState = 0xf
+)
+
+func (s ALUAState) String() string {
+	switch s {
+	case ALUAActiveOptimized:
+		return "active/optimized"
+	case ALUAActiveNonOptimized:
+		return "active/non-optimized"
+	case ALUAStandby:
+		return "standby"
+	case ALUAUnavailable:
+		return "unavailable"
+	case ALUATransitioning:
+		return "transitioning"
+	}
+	return fmt.Sprintf("ALUAState(0x%x)", byte(s))
+}
+
+func (s ALUAState) valid() bool {
+	switch s {
+	case ALUAActiveOptimized, ALUAActiveNonOptimized, ALUAStandby, ALUAUnavailable, ALUATransitioning:
+		return true
+	}
+	return false
+}
+
+// Supported states, as reported in the second byte of a target port group
+// descriptor: transitioning, unavailable, standby, active/non-optimized and
+// active/optimized.
+const aluaSupportedStates = 0x80 | 0x08 | 0x04 | 0x02 | 0x01
+
+// Status codes of a target port group descriptor.
+const (
+	aluaStatusExplicit = 0x1
+	aluaStatusImplicit = 0x2
+)
+
+// ALUAGroup is a target port group of the backstore, created under alua/ in
+// its configfs directory. The ports in a group share an access state, which
+// initiators such as dm-multipath use to pick a path.
+type ALUAGroup struct {
+	// Name is the group's directory under alua/.
+	Name string
+	// ID is the target port group identifier reported to initiators. Each
+	// group needs its own.
+	ID uint16
+	// State is the group's access state when the device is opened.
+	State ALUAState
+	// Preferred marks the group as the preferred path.
+	Preferred bool
+	// Explicit lets initiators change the group's state with SET TARGET
+	// PORT GROUPS. Changes through Device.SetALUAState are always allowed.
+	Explicit bool
+	// LUNs are the configfs directories of the fabric LUNs in the group,
+	// eg "/sys/kernel/config/target/iscsi/<iqn>/tpgt_1/lun/lun_0". The
+	// device's own LUN joins the first group unless a group lists it.
+	LUNs []string
+}
+
+// lunPather is implemented by fabrics whose LUN can be put in an ALUA group.
+type lunPather interface {
+	LUNPath(d *Device) string
+}
+
+type aluaGroup struct {
+	ALUAGroup
+	status byte
+	// ports are the relative target port identifiers of the group's LUNs.
+	ports []uint16
+}
+
+// aluaState is the device's view of its target port groups. It is kept here
+// rather than in the kernel, which hands ALUA over to TCMU devices entirely.
+type aluaState struct {
+	mu     sync.Mutex
+	groups []*aluaGroup
+	// local is the group holding the device's own LUN, whose state applies
+	// to every command, as the ring doesn't say which port a command came
+	// through.
+	local *aluaGroup
+	port  uint16
+	// attention is set when the state changes, until a command reports it.
+	attention bool
+}
+
+func newALUAState(groups []ALUAGroup) *aluaState {
+	if len(groups) == 0 {
+		return nil
+	}
+	a := &aluaState{}
+	for _, g := range groups {
+		a.groups = append(a.groups, &aluaGroup{ALUAGroup: g})
+	}
+	return a
+}
+
+func (d *Device) aluaGroupPath(name string) string {
+	return path.Join(d.BackstorePath(), "alua", name)
+}
+
+// createALUAGroups creates the handler's target port groups, or takes over
+// the ones left by a previous process.
+func (d *Device) createALUAGroups() error {
+	for _, g := range d.scsi.ALUAGroups {
+		if !g.State.valid() {
+			return fmt.Errorf("ALUA group %s has invalid state 0x%x", g.Name, byte(g.State))
+		}
+		dir := d.aluaGroupPath(g.Name)
+		logrus.Debugf("Creating directory: %s", dir)
+		if err := d.fs.MkdirAll(dir, 0755); err != nil && !os.IsExist(err) {
+			return err
+		}
+		// The kernel only takes the ID once.
+		id := strconv.Itoa(int(g.ID))
+		cur, err := d.fs.ReadFile(path.Join(dir, "tg_pt_gp_id"))
+		if err != nil {
+			return err
+		}
+		if strings.TrimSpace(string(cur)) != id {
+			if err := writeLines(d.fs, path.Join(dir, "tg_pt_gp_id"), []string{id}); err != nil {
+				return err
+			}
+		}
+		accessType, preferred := "1", "0"
+		if g.Explicit {
+			accessType = "3"
+		}
+		if g.Preferred {
+			preferred = "1"
+		}
+		if err := writeLines(d.fs, path.Join(dir, "alua_access_type"), []string{accessType}); err != nil {
+			return err
+		}
+		if err := writeLines(d.fs, path.Join(dir, "preferred"), []string{preferred}); err != nil {
+			return err
+		}
+		d.mirrorALUAState(g.Name, g.State)
+	}
+	return nil
+}
+
+// joinALUAGroups puts the fabric LUNs in their groups, once the fabric has
+// created them.
+func (d *Device) joinALUAGroups() error {
+	a := d.alua
+	if a == nil {
+		return nil
+	}
+	own := ""
+	if f, ok := d.fabric().(lunPather); ok {
+		own = f.LUNPath(d)
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.local = a.groups[0]
+	for _, g := range a.groups {
+		g.ports = nil
+		for _, lun := range g.LUNs {
+			if lun == own {
+				a.local = g
+			}
+		}
+	}
+	for _, g := range a.groups {
+		luns := g.LUNs
+		if g == a.local && own != "" && !containsString(luns, own) {
+			luns = append([]string{own}, luns...)
+		}
+		for _, lun := range luns {
+			if err := writeLines(d.fs, path.Join(lun, "alua_tg_pt_gp"), []string{g.Name}); err != nil {
+				return err
+			}
+			port := d.relativePort(lun)
+			g.ports = append(g.ports, port)
+			if lun == own {
+				a.port = port
+			}
+		}
+	}
+	return nil
+}
+
+// relativePort returns the relative target port identifier of a fabric LUN.
+// The kernel only shows it in the LUN's statistics; failing that, the TPG tag
+// is used, which is what it usually is.
+func (d *Device) relativePort(lun string) uint16 {
+	b, err := d.fs.ReadFile(path.Join(lun, "statistics", "scsi_port", "indx"))
+	if err == nil {
+		if v, err := strconv.ParseUint(strings.TrimSpace(string(b)), 10, 16); err == nil {
+			return uint16(v)
+		}
+	}
+	tpgt := path.Base(path.Dir(path.Dir(lun)))
+	v, _ := strconv.ParseUint(strings.TrimPrefix(tpgt, "tpgt_"), 10, 16)
+	return uint16(v)
+}
+
+// removeALUAGroups removes every target port group the backstore has, which
+// the kernel requires before it can be removed.
+func (d *Device) removeALUAGroups(ctx context.Context) error {
+	groups, err := d.fs.ReadDir(path.Join(d.BackstorePath(), "alua"))
+	if err != nil {
+		return nil
+	}
+	for _, g := range groups {
+		if !g.IsDir() || g.Name() == defaultALUAGroup {
+			continue
+		}
+		if err := remove(ctx, d.fs, d.aluaGroupPath(g.Name())); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// mirrorALUAState records a group's state in configfs, for the benefit of
+// tools like targetcli. Kernels that leave ALUA to TCMU may refuse it, which
+// is fine: the state the device reports is its own.
+func (d *Device) mirrorALUAState(name string, state ALUAState) {
+	err := writeLines(d.fs, path.Join(d.aluaGroupPath(name), "alua_access_state"), []string{strconv.Itoa(int(state))})
+	if err != nil {
+		logrus.Debugf("Not recording ALUA state of %s in configfs: %v", name, err)
+	}
+}
+
+// SetALUAState changes the access state of one of the device's target port
+// groups, as an implicit transition. Initiators are told with a unit
+// attention on their next command, and pick up the new state with REPORT
+// TARGET PORT GROUPS; moving the group with the device's own LUN to standby
+// or unavailable fails commands through it over to the other paths.
+func (d *Device) SetALUAState(group string, state ALUAState) error {
+	if !state.valid() {
+		return fmt.Errorf("invalid ALUA state 0x%x", byte(state))
+	}
+	if err := d.setALUAState(group, state, aluaStatusImplicit); err != nil {
+		return err
+	}
+	d.alua.mu.Lock()
+	d.alua.attention = true
+	d.alua.mu.Unlock()
+	return nil
+}
+
+func (d *Device) setALUAState(group string, state ALUAState, status byte) error {
+	if d.alua == nil {
+		return fmt.Errorf("device %s has no ALUA groups", d.scsi.VolumeName)
+	}
+	d.alua.mu.Lock()
+	var g *aluaGroup
+	for _, x := range d.alua.groups {
+		if x.Name == group {
+			g = x
+		}
+	}
+	if g == nil {
+		d.alua.mu.Unlock()
+		return fmt.Errorf("device %s has no ALUA group %s", d.scsi.VolumeName, group)
+	}
+	g.State = state
+	g.status = status
+	d.alua.mu.Unlock()
+	logrus.Infof("ALUA group %s of %s is now %s", group, d.scsi.VolumeName, state)
+	d.mirrorALUAState(group, state)
+	return nil
+}
+
+// ALUAGroups returns the device's target port groups, with their current
+// states.
+func (d *Device) ALUAGroups() []ALUAGroup {
+	if d.alua == nil {
+		return nil
+	}
+	d.alua.mu.Lock()
+	defer d.alua.mu.Unlock()
+	out := make([]ALUAGroup, len(d.alua.groups))
+	for i, g := range d.alua.groups {
+		out[i] = g.ALUAGroup
+	}
+	return out
+}
+
+// tpgs returns the TPGS field of the standard INQUIRY data, shifted into
+// place: implicit ALUA if the device has target port groups, and explicit too
+// if any of them allows it.
+func (d *Device) tpgs() byte {
+	if d == nil || d.alua == nil {
+		return 0
+	}
+	d.alua.mu.Lock()
+	defer d.alua.mu.Unlock()
+	v := byte(0x10)
+	for _, g := range d.alua.groups {
+		if g.Explicit {
+			v |= 0x20
+		}
+	}
+	return v
+}
+
+// aluaPort returns the device's relative target port and target port group
+// identifiers, for the device identification VPD page.
+func (d *Device) aluaPort() (port, group uint16, ok bool) {
+	if d == nil || d.alua == nil {
+		return 0, 0, false
+	}
+	d.alua.mu.Lock()
+	defer d.alua.mu.Unlock()
+	if d.alua.local == nil {
+		return 0, 0, false
+	}
+	return d.alua.port, d.alua.local.ID, true
+}
+
+// checkALUA decides whether cmd may run, given the access state of the
+// device's group. If not, it returns the response to fail it with.
+func (d *Device) checkALUA(cmd *SCSICmd) (SCSIResponse, bool) {
+	if d.alua == nil {
+		return SCSIResponse{}, true
+	}
+	d.alua.mu.Lock()
+	defer d.alua.mu.Unlock()
+	op := cmd.Command()
+	if d.alua.attention && op != scsi.Inquiry && op != scsi.ReportLuns && op != scsi.RequestSense {
+		// There's no telling initiators apart, so whichever asks first
+		// gets it; the others see the new state when they next check.
+		d.alua.attention = false
+		return cmd.CheckCondition(scsi.SenseUnitAttention, scsi.AscAsymmetricAccessStateChanged), false
+	}
+	if d.alua.local == nil {
+		return SCSIResponse{}, true
+	}
+	switch op {
+	case scsi.Inquiry, scsi.ReportLuns, scsi.RequestSense, scsi.ReadBuffer, scsi.WriteBuffer, scsi.MaintenanceIn:
+		return SCSIResponse{}, true
+	}
+	switch d.alua.local.State {
+	case ALUAStandby:
+		switch op {
+		case scsi.ModeSense, scsi.ModeSense10, scsi.ModeSelect, scsi.ModeSelect10,
+			scsi.LogSense, scsi.LogSelect, scsi.ReceiveDiagnostic, scsi.SendDiagnostic,
+			scsi.PersistentReserveIn, scsi.PersistentReserveOut, scsi.MaintenanceOut:
+			return SCSIResponse{}, true
+		case scsi.ServiceActionIn16:
+			if cmd.GetCDB(1)&0x1f == scsi.SaiReadCapacity16 {
+				return SCSIResponse{}, true
+			}
+		}
+		return cmd.CheckCondition(scsi.SenseNotReady, scsi.AscLunNotAccessibleStandby), false
+	case ALUAUnavailable:
+		if op == scsi.MaintenanceOut {
+			return SCSIResponse{}, true
+		}
+		return cmd.CheckCondition(scsi.SenseNotReady, scsi.AscLunNotAccessibleUnavailable), false
+	case ALUATransitioning:
+		return cmd.CheckCondition(scsi.SenseNotReady, scsi.AscLunNotAccessibleTransitioning), false
+	}
+	return SCSIResponse{}, true
+}
+
+// EmulateMaintenanceIn responds to the MAINTENANCE IN service actions the
+// device emulates: REPORT TARGET PORT GROUPS.
+func EmulateMaintenanceIn(cmd *SCSICmd) (SCSIResponse, error) {
+	if cmd.GetCDB(1)&0x1f == scsi.MiReportTargetPgs {
+		return EmulateReportTargetPortGroups(cmd)
+	}
+	return cmd.NotHandled(), nil
+}
+
+// EmulateMaintenanceOut responds to the MAINTENANCE OUT service actions the
+// device emulates: SET TARGET PORT GROUPS.
+func EmulateMaintenanceOut(cmd *SCSICmd) (SCSIResponse, error) {
+	if cmd.GetCDB(1)&0x1f == scsi.MoSetTargetPgs {
+		return EmulateSetTargetPortGroups(cmd)
+	}
+	return cmd.NotHandled(), nil
+}
+
+// EmulateReportTargetPortGroups reports the device's target port groups and
+// their states. Devices without ALUA groups don't support the command.
+func EmulateReportTargetPortGroups(cmd *SCSICmd) (SCSIResponse, error) {
+	a := cmd.Device().alua
+	if a == nil {
+		return cmd.NotHandled(), nil
+	}
+	order := binary.BigEndian
+	ext := cmd.GetCDB(1)&0xe0 == scsi.MiExtHdrParamFmt
+	hdr := 4
+	if ext {
+		hdr = 8
+	}
+	data := make([]byte, hdr)
+
+	a.mu.Lock()
+	for _, g := range a.groups {
+		desc := make([]byte, 8, 8+4*len(g.ports))
+		desc[0] = byte(g.State)
+		if g.Preferred {
+			desc[0] |= 0x80
+		}
+		desc[1] = aluaSupportedStates
+		order.PutUint16(desc[2:4], g.ID)
+		desc[5] = g.status
+		desc[7] = byte(len(g.ports))
+		for _, p := range g.ports {
+			desc = append(desc, 0, 0, byte(p>>8), byte(p))
+		}
+		data = append(data, desc...)
+	}
+	a.mu.Unlock()
+
+	order.PutUint32(data[0:4], uint32(len(data)-4))
+	if ext {
+		data[4] = 0x10 // format type 1; no implicit transition time
+	}
+	if alloc := int(cmd.XferLen()); alloc < len(data) {
+		data = data[:alloc]
+	}
+	if _, err := cmd.Write(data); err != nil {
+		return SCSIResponse{}, err
+	}
+	return cmd.Ok(), nil
+}
+
+// EmulateSetTargetPortGroups changes the states of the groups listed in the
+// parameter data, all of which must allow explicit transitions.
+func EmulateSetTargetPortGroups(cmd *SCSICmd) (SCSIResponse, error) {
+	d := cmd.Device()
+	if d.alua == nil {
+		return cmd.NotHandled(), nil
+	}
+	n := int(cmd.XferLen())
+	if n == 0 {
+		return cmd.Ok(), nil
+	}
+	if n < 4 || (n-4)%4 != 0 {
+		return cmd.CheckCondition(scsi.SenseIllegalRequest, scsi.AscParameterListLengthError), nil
+	}
+	data := make([]byte, n)
+	if _, err := cmd.Read(data); err != nil {
+		return cmd.CheckCondition(scsi.SenseIllegalRequest, scsi.AscParameterListLengthError), nil
+	}
+
+	type change struct {
+		name  string
+		state ALUAState
+	}
+	var changes []change
+	groups := d.ALUAGroups()
+	for off := 4; off < n; off += 4 {
+		state := ALUAState(data[off] & 0x0f)
+		id := binary.BigEndian.Uint16(data[off+2 : off+4])
+		switch state {
+		case ALUAActiveOptimized, ALUAActiveNonOptimized, ALUAStandby, ALUAUnavailable:
+		default:
+			return cmd.CheckCondition(scsi.SenseIllegalRequest, scsi.AscInvalidFieldInParameterList), nil
+		}
+		found := false
+		for _, g := range groups {
+			if g.ID == id && g.Explicit {
+				changes = append(changes, change{g.Name, state})
+				found = true
+			}
+		}
+		if !found {
+			return cmd.CheckCondition(scsi.SenseIllegalRequest, scsi.AscInvalidFieldInParameterList), nil
+		}
+	}
+	for _, c := range changes {
+		if err := d.setALUAState(c.name, c.state, aluaStatusExplicit); err != nil {
+			return cmd.TargetFailure(), nil
+		}
+	}
+	return cmd.Ok(), nil
+}
+
+func containsString(list []string, s string) bool {
+	for _, x := range list {
+		if x == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,83 @@
+package tcmu
+
+import "sync"
+
+// defaultQueueDepth is how many commands AsyncDevReady keeps in flight when
+// it isn't told; it is the kernel's default hw_queue_depth for TCMU.
+const defaultQueueDepth = 128
+
+// AsyncSCSICmdHandler handles SCSI commands without tying up a goroutine for
+// each. HandleCommandAsync should start the work and return; complete is then
+// called with the response, exactly once, from any goroutine.
+type AsyncSCSICmdHandler interface {
+	HandleCommandAsync(cmd *SCSICmd, complete func(SCSIResponse))
+}
+
+// AsyncSCSICmdHandlerFunc lets an ordinary function be used as an
+// AsyncSCSICmdHandler.
+type AsyncSCSICmdHandlerFunc func(cmd *SCSICmd, complete func(SCSIResponse))
+
+// HandleCommandAsync calls f(cmd, complete).
+func (f AsyncSCSICmdHandlerFunc) HandleCommandAsync(cmd *SCSICmd, complete func(SCSIResponse)) {
+	f(cmd, complete)
+}
+
+// AsyncDevReady hands commands to h from a single goroutine, keeping up to
+// queueDepth of them in flight; the next one waits for a completion. Zero
+// means 128, the kernel's default hw_queue_depth. Once the device stops, it
+// waits for the outstanding completions before finishing.
+func AsyncDevReady(h AsyncSCSICmdHandler, queueDepth int) DevReadyFunc {
+	if queueDepth <= 0 {
+		queueDepth = defaultQueueDepth
+	}
+	return func(in chan *SCSICmd, out chan SCSIResponse) error {
+		go func() {
+			slots := make(chan struct{}, queueDepth)
+			var w sync.WaitGroup
+			for cmd := range in {
+				slots <- struct{}{}
+				w.Add(1)
+				var once sync.Once
+				h.HandleCommandAsync(cmd, func(resp SCSIResponse) {
+					once.Do(func() {
+						out <- resp
+						<-slots
+						w.Done()
+					})
+				})
+			}
+			w.Wait()
+			close(out)
+		}()
+		return nil
+	}
+}
+
+// AsyncHandler adapts a synchronous handler, such as a CmdMux, for use with
+// AsyncDevReady, running each command on its own goroutine. An error from h
+// fails the command, as it would for a synchronous worker.
+func AsyncHandler(h SCSICmdHandler) AsyncSCSICmdHandler {
+	return AsyncSCSICmdHandlerFunc(func(cmd *SCSICmd, complete func(SCSIResponse)) {
+		go func() {
+			resp, err := h.HandleCommand(cmd)
+			if err != nil {
+				resp = cmd.Device().handlerFailed(cmd, err)
+			}
+			complete(resp)
+		}()
+	})
+}
+
+// SyncHandler adapts an asynchronous handler for use wherever a
+// SCSICmdHandler is wanted, such as in a CmdMux or with MultiThreadedDevReady,
+// by waiting for each command to complete.
+func SyncHandler(h AsyncSCSICmdHandler) SCSICmdHandler {
+	return SCSICmdHandlerFunc(func(cmd *SCSICmd) (SCSIResponse, error) {
+		done := make(chan SCSIResponse, 1)
+		var once sync.Once
+		h.HandleCommandAsync(cmd, func(resp SCSIResponse) {
+			once.Do(func() { done <- resp })
+		})
+		return <-done, nil
+	})
+}
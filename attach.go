@@ -0,0 +1,132 @@
+package tcmu
+
+import (
+	"context"
+	"fmt"
+	"path"
+	"strings"
+
+	"github.com/coreos/go-tcmu/scsi"
+	"github.com/sirupsen/logrus"
+	"golang.org/x/sys/unix"
+)
+
+// AttachTCMUDevice takes over a device left running by a previous process,
+// typically an earlier instance of the same daemon that was stopped with
+// Detach. Unlike OpenTCMUDevice, it leaves the configfs tree, the fabric's
+// target and the block device alone, so filesystems mounted on it stay
+// mounted; only whatever is missing of the export is recreated. Commands the
+// previous process didn't complete are failed back to the kernel with a
+// retryable status, and the ring is taken over from there.
+func AttachTCMUDevice(devPath string, scsi *SCSIHandler) (*Device, error) {
+	return AttachTCMUDeviceContext(context.Background(), devPath, scsi)
+}
+
+// AttachTCMUDeviceContext is AttachTCMUDevice, but gives up as soon as ctx is
+// cancelled or its deadline passes. Errors are *StepErrors, as for
+// OpenTCMUDeviceContext. A failed attach leaves the existing device as it was.
+func AttachTCMUDeviceContext(ctx context.Context, devPath string, scsi *SCSIHandler) (*Device, error) {
+	d := newDevice(devPath, scsi)
+	enabled, err := d.fs.ReadFile(path.Join(d.hbaDir, scsi.VolumeName, "enable"))
+	if err != nil {
+		return nil, stepError(StepConfigfs, err)
+	}
+	if strings.TrimSpace(string(enabled)) != "1" {
+		return nil, stepError(StepConfigfs, fmt.Errorf("%s is not enabled", path.Join(d.hbaDir, scsi.VolumeName)))
+	}
+	if scsi.Netlink != nil {
+		scsi.Netlink.register(d)
+	}
+	if err := d.resume(); err != nil {
+		return nil, d.abortAttach(stepError(StepUIO, err))
+	}
+
+	// The previous process may not have got as far as exporting it.
+	if err := d.postEnableTcmu(ctx); err != nil {
+		return nil, d.abortAttach(err)
+	}
+	return d, nil
+}
+
+// resume opens the UIO device, gets rid of whatever the previous process left
+// in the ring, and starts serving it.
+func (d *Device) resume() error {
+	backstore := path.Join(d.hbaDir, d.scsi.VolumeName)
+	blockDev := path.Join(backstore, "action", "block_dev")
+	resetRing := path.Join(backstore, "action", "reset_ring")
+	_, err := d.fs.Stat(resetRing)
+	canReset := err == nil
+	if canReset {
+		// Hold new commands back while the ring is reset, and let the
+		// kernel fail the old ones with a status the initiator retries.
+		if err := writeLines(d.fs, blockDev, []string{"1"}); err != nil {
+			return err
+		}
+		defer writeLines(d.fs, blockDev, []string{"0"})
+		if err := writeLines(d.fs, resetRing, []string{"1"}); err != nil {
+			return err
+		}
+	}
+	if err := d.findDevice(); err != nil {
+		return err
+	}
+	if !canReset {
+		d.failPending()
+	}
+	return d.serve()
+}
+
+// abortAttach lets go of a device that couldn't be attached, without tearing
+// it down, and returns err.
+func (d *Device) abortAttach(err error) error {
+	ctx, cancel := context.WithTimeout(context.Background(), removeTimeout)
+	defer cancel()
+	if derr := d.Detach(ctx); derr != nil {
+		logrus.Errorf("Failed to detach from %s: %v", d.scsi.VolumeName, derr)
+	}
+	return err
+}
+
+// failPending completes every command left in the ring with BUSY, for kernels
+// that can't reset the ring themselves, so the initiator retries them.
+func (d *Device) failPending() {
+	n := 0
+	for d.mbCmdTail() != d.mbCmdHead() {
+		off := d.tailEntryOff()
+		if d.entHdrOp(off) == tcmuOpCmd {
+			d.setEntRespSCSIStatus(off, scsi.SamStatBusy)
+			n++
+		}
+		d.mbSetTail((d.mbCmdTail() + uint32(d.entHdrGetLen(off))) % d.mbCmdrSize())
+	}
+	d.cmdTail = d.mbCmdTail()
+	if n == 0 {
+		return
+	}
+	logrus.Infof("Failed %d commands left over in %s", n, d.scsi.VolumeName)
+	if _, err := unix.Write(d.uioFd, make([]byte, 4)); err != nil {
+		logrus.Errorf("Failed to notify the kernel: %v", err)
+	}
+}
+
+// Detach stops serving the device without tearing it down, so that another
+// process can take it over with AttachTCMUDevice. In-flight commands are
+// drained first, as in Shutdown; commands arriving after that wait in the
+// ring for the next process, up to the kernel's command timeout.
+func (d *Device) Detach(ctx context.Context) error {
+	if err := d.drain(ctx); err != nil {
+		return err
+	}
+	if err := d.stopPoll(ctx); err != nil {
+		return stepError(StepUIO, err)
+	}
+	d.detach()
+	return nil
+}
+
+func (d *Device) detach() {
+	d.unmap()
+	if d.scsi.Netlink != nil {
+		d.scsi.Netlink.unregister(d)
+	}
+}
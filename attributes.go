@@ -0,0 +1,192 @@
+package tcmu
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+)
+
+// DeviceAttributes are the LIO attributes of the TCMU backstore, found under
+// attrib/ in its configfs directory. A nil field leaves the kernel's default
+// alone. They are validated against the attributes the running kernel exposes
+// and applied before the device is enabled; Device.Attributes reads back the
+// live values.
+type DeviceAttributes struct {
+	// MaxDataAreaMB is the size, in MiB, of the data area shared with the
+	// kernel, which bounds how much data can be in flight.
+	MaxDataAreaMB *int
+	// HwMaxSectors is the largest transfer, in blocks, the kernel will send
+	// in a single command.
+	HwMaxSectors *int
+	// QfullTimeOut is how long, in seconds, a command waits for room in the
+	// ring before failing. Zero fails it at once; -1 waits up to CmdTimeOut.
+	QfullTimeOut *int
+	// CmdTimeOut is how long, in seconds, the kernel waits for a command to
+	// complete before aborting it. Zero waits forever.
+	CmdTimeOut *int
+	// EmulateWriteCache reports a volatile write cache to initiators.
+	EmulateWriteCache *bool
+	// EmulateTPU and EmulateTPWS advertise thin provisioning through UNMAP
+	// and WRITE SAME with UNMAP respectively.
+	EmulateTPU  *bool
+	EmulateTPWS *bool
+	// NlReplySupported makes the kernel wait for replies to its netlink
+	// events. It defaults to 1 when the handler has a Netlink listener.
+	NlReplySupported *int
+	// HwQueueDepth is the kernel's queue depth for the device. It is read
+	// only: Device.Attributes fills it in, and it is ignored otherwise.
+	HwQueueDepth *int
+}
+
+// Int returns a pointer to v, for filling in DeviceAttributes, or the owner
+// of a LoopbackFabric's entry.
+func Int(v int) *int {
+	return &v
+}
+
+// Bool returns a pointer to v, for filling in DeviceAttributes.
+func Bool(v bool) *bool {
+	return &v
+}
+
+// UnsupportedAttributeError is returned when an attribute is set that the
+// running kernel doesn't have.
+type UnsupportedAttributeError struct {
+	Name string
+}
+
+func (e *UnsupportedAttributeError) Error() string {
+	return fmt.Sprintf("kernel has no device attribute %s", e.Name)
+}
+
+type deviceAttr struct {
+	name string
+	// control attributes can only be set through the backstore's control
+	// file, before it is enabled.
+	control  bool
+	readOnly bool
+	value    attrValue
+}
+
+type attrValue interface {
+	// get returns the value to write, if it is set.
+	get() (string, bool)
+	set(s string) error
+}
+
+type intAttr struct{ p **int }
+
+func (a intAttr) get() (string, bool) {
+	if *a.p == nil {
+		return "", false
+	}
+	return strconv.Itoa(**a.p), true
+}
+
+func (a intAttr) set(s string) error {
+	v, err := strconv.Atoi(s)
+	if err != nil {
+		return err
+	}
+	*a.p = &v
+	return nil
+}
+
+type boolAttr struct{ p **bool }
+
+func (a boolAttr) get() (string, bool) {
+	if *a.p == nil {
+		return "", false
+	}
+	if **a.p {
+		return "1", true
+	}
+	return "0", true
+}
+
+func (a boolAttr) set(s string) error {
+	v, err := strconv.Atoi(s)
+	if err != nil {
+		return err
+	}
+	b := v != 0
+	*a.p = &b
+	return nil
+}
+
+func (a *DeviceAttributes) fields() []deviceAttr {
+	return []deviceAttr{
+		{name: "max_data_area_mb", control: true, value: intAttr{&a.MaxDataAreaMB}},
+		{name: "hw_max_sectors", control: true, value: intAttr{&a.HwMaxSectors}},
+		{name: "nl_reply_supported", control: true, value: intAttr{&a.NlReplySupported}},
+		{name: "qfull_time_out", value: intAttr{&a.QfullTimeOut}},
+		{name: "cmd_time_out", value: intAttr{&a.CmdTimeOut}},
+		{name: "emulate_write_cache", value: boolAttr{&a.EmulateWriteCache}},
+		{name: "emulate_tpu", value: boolAttr{&a.EmulateTPU}},
+		{name: "emulate_tpws", value: boolAttr{&a.EmulateTPWS}},
+		{name: "hw_queue_depth", readOnly: true, value: intAttr{&a.HwQueueDepth}},
+	}
+}
+
+// attributes returns the attributes to apply to the backstore, filling in the
+// ones the device itself needs.
+func (d *Device) attributes() DeviceAttributes {
+	attrs := d.scsi.Attributes
+	if attrs.NlReplySupported == nil && d.scsi.Netlink != nil {
+		attrs.NlReplySupported = Int(1)
+	}
+	return attrs
+}
+
+// applyAttributes checks that every attribute set is known to the kernel,
+// then writes them: the control ones as lines for the control file, which it
+// returns, and the rest straight into attrib/.
+func (d *Device) applyAttributes(attrs DeviceAttributes) ([]string, error) {
+	backstore := path.Join(d.hbaDir, d.scsi.VolumeName)
+	fields := attrs.fields()
+	for _, f := range fields {
+		if _, set := f.value.get(); !set || f.readOnly {
+			continue
+		}
+		if _, err := d.fs.Stat(path.Join(backstore, "attrib", f.name)); os.IsNotExist(err) {
+			return nil, &UnsupportedAttributeError{Name: f.name}
+		}
+	}
+	var control []string
+	for _, f := range fields {
+		v, set := f.value.get()
+		if !set || f.readOnly {
+			continue
+		}
+		if f.control {
+			control = append(control, fmt.Sprintf("%s=%s", f.name, v))
+			continue
+		}
+		if err := writeLines(d.fs, path.Join(backstore, "attrib", f.name), []string{v}); err != nil {
+			return nil, err
+		}
+	}
+	return control, nil
+}
+
+// Attributes reads the device's attributes back from configfs. Attributes
+// the running kernel doesn't have are left nil.
+func (d *Device) Attributes() (DeviceAttributes, error) {
+	var attrs DeviceAttributes
+	backstore := path.Join(d.hbaDir, d.scsi.VolumeName)
+	for _, f := range attrs.fields() {
+		b, err := d.fs.ReadFile(path.Join(backstore, "attrib", f.name))
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return attrs, err
+		}
+		if err := f.value.set(strings.TrimSpace(string(b))); err != nil {
+			return attrs, fmt.Errorf("reading attribute %s: %v", f.name, err)
+		}
+	}
+	return attrs, nil
+}
@@ -0,0 +1,119 @@
+package tcmu
+
+import (
+	"sync"
+	"sync/atomic"
+)
+
+// minBufferClass is the smallest buffer the pool hands out.
+const minBufferClass = 4096
+
+// bufferPool is a device's pool of scratch buffers, shared by all its workers.
+// Buffers come in power of two size classes, up to the first one big enough
+// for the whole kernel data area, which no command can exceed. Once the
+// buffers handed out would hold more than the data area, any more are
+// allocated to size instead of being taken from the pool.
+type bufferPool struct {
+	// inUse is how many bytes of buffers are handed out, allocs how many
+	// buffers the pool has had to allocate. They come first, as they are
+	// used atomically and must be 8 byte aligned on 32 bit platforms.
+	inUse  int64
+	allocs uint64
+
+	classes []sync.Pool
+	limit   int
+}
+
+// newBufferPool returns a pool for a data area of dataSize bytes.
+func newBufferPool(dataSize int) *bufferPool {
+	n := 1
+	for size := minBufferClass; size < dataSize; size <<= 1 {
+		n++
+	}
+	return &bufferPool{
+		classes: make([]sync.Pool, n),
+		limit:   dataSize,
+	}
+}
+
+// class returns the index of the smallest class holding n bytes, and that
+// class's size. It is -1 for sizes beyond the largest class.
+func (p *bufferPool) class(n int) (int, int) {
+	size := minBufferClass
+	for i := range p.classes {
+		if n <= size {
+			return i, size
+		}
+		size <<= 1
+	}
+	return -1, n
+}
+
+// get returns a buffer of length n. It should be given back with put.
+func (p *bufferPool) get(n int) []byte {
+	if p == nil {
+		return make([]byte, n)
+	}
+	i, size := p.class(n)
+	if i < 0 || !p.reserve(size) {
+		atomic.AddUint64(&p.allocs, 1)
+		atomic.AddInt64(&p.inUse, int64(n))
+		return make([]byte, n)
+	}
+	if v := p.classes[i].Get(); v != nil {
+		return (*v.(*[]byte))[:n]
+	}
+	atomic.AddUint64(&p.allocs, 1)
+	return make([]byte, n, size)
+}
+
+// reserve counts size more bytes as handed out, unless that would take the
+// pool past its limit. A buffer bigger than the limit can still be had while
+// no others are out.
+func (p *bufferPool) reserve(size int) bool {
+	for {
+		inUse := atomic.LoadInt64(&p.inUse)
+		if inUse > 0 && inUse+int64(size) > int64(p.limit) {
+			return false
+		}
+		if atomic.CompareAndSwapInt64(&p.inUse, inUse, inUse+int64(size)) {
+			return true
+		}
+	}
+}
+
+// put returns a buffer from get to the pool.
+func (p *bufferPool) put(b []byte) {
+	if p == nil || b == nil {
+		return
+	}
+	atomic.AddInt64(&p.inUse, -int64(cap(b)))
+	i, size := p.class(cap(b))
+	if i < 0 || size != cap(b) {
+		return
+	}
+	b = b[:size]
+	p.classes[i].Put(&b)
+}
+
+// GetBuffer returns a scratch buffer of n bytes from the device's pool, which
+// all of its workers share. Give it back with PutBuffer once done with it.
+func (d *Device) GetBuffer(n int) []byte {
+	return d.buffers.get(n)
+}
+
+// PutBuffer returns a buffer from GetBuffer to the pool. The buffer must not be
+// used afterwards.
+func (d *Device) PutBuffer(b []byte) {
+	d.buffers.put(b)
+}
+
+// scratch returns a buffer of n bytes for the command: Buf if it is big enough,
+// and a pooled buffer otherwise. done gives the pooled buffer back.
+func (c *SCSICmd) scratch(n int) (buf []byte, done func()) {
+	if len(c.Buf) >= n {
+		return c.Buf[:n], func() {}
+	}
+	b := c.Device().GetBuffer(n)
+	return b, func() { c.Device().PutBuffer(b) }
+}
@@ -0,0 +1,65 @@
+package tcmu
+
+import "testing"
+
+func TestBufferPoolReuse(t *testing.T) {
+	p := newBufferPool(64 << 10)
+	b := p.get(5000)
+	if len(b) != 5000 || cap(b) != 8192 || p.inUse != 8192 {
+		t.Fatalf("got len %d cap %d, %d in use", len(b), cap(b), p.inUse)
+	}
+	p.put(b)
+	if p.inUse != 0 {
+		t.Errorf("%d in use after put", p.inUse)
+	}
+	if b := p.get(100); cap(b) != minBufferClass {
+		t.Errorf("got cap %d for 100 bytes", cap(b))
+	}
+}
+
+func TestBufferPoolLimit(t *testing.T) {
+	p := newBufferPool(64 << 10)
+	var out [][]byte
+	for i := 0; i < 4; i++ {
+		out = append(out, p.get(16<<10))
+	}
+	if p.inUse != 64<<10 || p.allocs != 4 {
+		t.Fatalf("%d in use, %d allocated", p.inUse, p.allocs)
+	}
+	// The pool is at its limit, so this comes to exactly the size asked.
+	extra := p.get(5000)
+	if cap(extra) != 5000 || p.inUse != 64<<10+5000 {
+		t.Errorf("got cap %d past the limit, %d in use", cap(extra), p.inUse)
+	}
+	p.put(extra)
+	for _, b := range out {
+		p.put(b)
+	}
+	if p.inUse != 0 {
+		t.Errorf("%d in use after put", p.inUse)
+	}
+
+}
+
+func TestBufferPoolBiggestClass(t *testing.T) {
+	// The biggest class is beyond the limit, but can be had while nothing
+	// else is out.
+	p := newBufferPool(40 << 10)
+	big := p.get(40 << 10)
+	if cap(big) != 64<<10 || p.inUse != 64<<10 {
+		t.Errorf("got cap %d, %d in use", cap(big), p.inUse)
+	}
+	if b := p.get(4096); cap(b) != 4096 || p.inUse != 64<<10+4096 {
+		t.Errorf("got cap %d, %d in use", cap(b), p.inUse)
+	}
+	p.put(big)
+}
+
+func TestBufferPoolNil(t *testing.T) {
+	var p *bufferPool
+	b := p.get(10)
+	if len(b) != 10 {
+		t.Errorf("got %d bytes", len(b))
+	}
+	p.put(b)
+}
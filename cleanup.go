@@ -0,0 +1,293 @@
+package tcmu
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const (
+	coreDir   = "/sys/kernel/config/target/core"
+	targetDir = "/sys/kernel/config/target"
+	procDir   = "/proc"
+
+	devConfigPrefix = "go-tcmu//"
+)
+
+// DeviceInfo describes a go-tcmu backstore found in configfs, whether or not
+// this process opened it.
+type DeviceInfo struct {
+	HBA        int
+	VolumeName string
+	// Path is the backstore's configfs directory.
+	Path string
+	// Config is the backstore's dev_config, which starts with "go-tcmu//".
+	Config string
+	// Enabled reports whether the backstore was enabled.
+	Enabled bool
+	// UIO is the name of the backstore's UIO device, eg "uio0", if it has
+	// one.
+	UIO string
+	// InUse reports whether some process has the UIO device open, and so
+	// is presumably serving it.
+	InUse bool
+	// LUNs are the configfs directories of the fabric LUNs linked to the
+	// backstore.
+	LUNs []string
+
+	// links are the symlinks in LUNs, which needn't be named after the
+	// volume if something else made them.
+	links []string
+}
+
+// ListDevices finds every go-tcmu backstore on the system.
+func ListDevices() ([]DeviceInfo, error) {
+	return ListDevicesFS(OSFS{})
+}
+
+// ListDevicesFS is ListDevices, reaching configfs, sysfs, /dev and /proc
+// through fs.
+func ListDevicesFS(fs FS) ([]DeviceInfo, error) {
+	backstores, err := fs.Glob(path.Join(coreDir, "user_*", "*"))
+	if err != nil {
+		return nil, err
+	}
+	uios := uioDevices(fs)
+	open := openUIODevices(fs)
+	links := fabricLinks(fs)
+
+	var out []DeviceInfo
+	for _, b := range backstores {
+		hba, err := strconv.Atoi(strings.TrimPrefix(path.Base(path.Dir(b)), "user_"))
+		if err != nil {
+			continue
+		}
+		if st, err := fs.Stat(b); err != nil || !st.IsDir() {
+			continue
+		}
+		info := DeviceInfo{
+			HBA:        hba,
+			VolumeName: path.Base(b),
+			Path:       b,
+		}
+		if cfg, err := fs.ReadFile(path.Join(b, "attrib", "dev_config")); err == nil {
+			info.Config = strings.TrimSpace(string(cfg))
+		}
+		key := fmt.Sprintf("%d/%s", hba, info.VolumeName)
+		if u, ok := uios[key]; ok {
+			info.UIO = u.name
+			if info.Config == "" {
+				info.Config = u.config
+			}
+		}
+		if !strings.HasPrefix(info.Config, devConfigPrefix) {
+			continue
+		}
+		if enabled, err := fs.ReadFile(path.Join(b, "enable")); err == nil {
+			info.Enabled = strings.TrimSpace(string(enabled)) == "1"
+		}
+		info.InUse = info.UIO != "" && open[path.Join(devRoot, info.UIO)]
+		info.links = links[b]
+		for _, l := range info.links {
+			info.LUNs = append(info.LUNs, path.Dir(l))
+		}
+		out = append(out, info)
+	}
+	return out, nil
+}
+
+type uioDevice struct {
+	name   string
+	config string
+}
+
+// uioDevices maps "hba/volume" to the TCMU UIO device for it.
+func uioDevices(fs FS) map[string]uioDevice {
+	out := make(map[string]uioDevice)
+	names, _ := fs.Glob(path.Join(uioClassDir, "uio*", "name"))
+	for _, n := range names {
+		b, err := fs.ReadFile(n)
+		if err != nil {
+			continue
+		}
+		split := strings.SplitN(strings.TrimRight(string(b), "\n"), "/", 4)
+		if split[0] != "tcm-user" || len(split) < 4 {
+			continue
+		}
+		out[split[1]+"/"+split[2]] = uioDevice{name: path.Base(path.Dir(n)), config: split[3]}
+	}
+	return out
+}
+
+// openUIODevices returns the UIO device nodes that any process has open.
+func openUIODevices(fs FS) map[string]bool {
+	out := make(map[string]bool)
+	fds, _ := fs.Glob(path.Join(procDir, "[0-9]*", "fd", "*"))
+	for _, fd := range fds {
+		target, err := fs.Readlink(fd)
+		if err != nil {
+			continue
+		}
+		if strings.HasPrefix(target, path.Join(devRoot, "uio")) {
+			out[target] = true
+		}
+	}
+	return out
+}
+
+// fabricLinks maps backstore directories to the fabric LUN symlinks to them.
+func fabricLinks(fs FS) map[string][]string {
+	out := make(map[string][]string)
+	links, _ := fs.Glob(path.Join(targetDir, "*", "*", "tpgt_*", "lun", "lun_*", "*"))
+	for _, l := range links {
+		target, err := readLink(fs, l)
+		if err != nil {
+			continue
+		}
+		out[target] = append(out[target], l)
+	}
+	return out
+}
+
+// readLink returns the absolute path name links to, which configfs gives
+// relative to the link. It fails if name isn't a symlink.
+func readLink(fs FS, name string) (string, error) {
+	st, err := fs.Lstat(name)
+	if err != nil {
+		return "", err
+	}
+	if st.Mode()&os.ModeSymlink == 0 {
+		return "", fmt.Errorf("%s is not a symlink", name)
+	}
+	target, err := fs.Readlink(name)
+	if err != nil {
+		return "", err
+	}
+	if !path.IsAbs(target) {
+		target = path.Join(path.Dir(name), target)
+	}
+	return target, nil
+}
+
+// Cleanup tears down go-tcmu backstores left behind by processes that are
+// gone, along with whatever exported them: ACL mappings, fabric LUNs, and
+// targets left without LUNs. Backstores whose UIO device is still open are
+// never touched. If filter is set, only the orphans it accepts are removed.
+// Entries named after the removed volumes are also removed from devPaths,
+// such as "/dev/tcmufile". It returns the devices it removed.
+func Cleanup(filter func(DeviceInfo) bool, devPaths ...string) ([]DeviceInfo, error) {
+	return CleanupContext(context.Background(), OSFS{}, filter, devPaths...)
+}
+
+// CleanupContext is Cleanup, reaching the system through fs, and giving up as
+// soon as ctx is done.
+func CleanupContext(ctx context.Context, fs FS, filter func(DeviceInfo) bool, devPaths ...string) ([]DeviceInfo, error) {
+	devices, err := ListDevicesFS(fs)
+	if err != nil {
+		return nil, err
+	}
+	var removed []DeviceInfo
+	for _, info := range devices {
+		if info.InUse || (filter != nil && !filter(info)) {
+			continue
+		}
+		if err := teardownOrphan(ctx, fs, info, devPaths); err != nil {
+			return removed, fmt.Errorf("cleaning up %s: %v", info.Path, err)
+		}
+		removed = append(removed, info)
+	}
+	return removed, nil
+}
+
+// teardownOrphan removes a backstore, and everything that depends on it
+// first.
+func teardownOrphan(ctx context.Context, fs FS, info DeviceInfo, devPaths []string) error {
+	tpgs := make(map[string]bool)
+	for _, link := range info.links {
+		lun := path.Dir(link)
+		tpg := path.Dir(path.Dir(lun))
+		tpgs[tpg] = true
+		// Mapped LUNs link to the LUN, under whatever number the ACL gives
+		// it.
+		links, _ := fs.Glob(path.Join(tpg, "acls", "*", "lun_*", "*"))
+		for _, l := range links {
+			if target, err := readLink(fs, l); err != nil || target != lun {
+				continue
+			}
+			if err := remove(ctx, fs, l); err != nil {
+				return err
+			}
+			if err := remove(ctx, fs, path.Dir(l)); err != nil {
+				return err
+			}
+		}
+		if err := remove(ctx, fs, link); err != nil {
+			return err
+		}
+		if err := remove(ctx, fs, lun); err != nil {
+			return err
+		}
+	}
+
+	// Take down the targets that have nothing left to export.
+	var sorted []string
+	for tpg := range tpgs {
+		sorted = append(sorted, tpg)
+	}
+	sort.Strings(sorted)
+	for _, tpg := range sorted {
+		if luns, err := fs.ReadDir(path.Join(tpg, "lun")); err != nil || len(luns) > 0 {
+			continue
+		}
+		if err := removeEmptyTPG(ctx, fs, tpg); err != nil {
+			return err
+		}
+	}
+
+	groups, _ := fs.ReadDir(path.Join(info.Path, "alua"))
+	for _, g := range groups {
+		if g.IsDir() && g.Name() != defaultALUAGroup {
+			if err := remove(ctx, fs, path.Join(info.Path, "alua", g.Name())); err != nil {
+				return err
+			}
+		}
+	}
+	if err := remove(ctx, fs, info.Path); err != nil {
+		return err
+	}
+
+	for _, dir := range devPaths {
+		dev := path.Join(dir, info.VolumeName)
+		st, err := fs.Lstat(dev)
+		if err != nil {
+			continue
+		}
+		if st.Mode()&(os.ModeDevice|os.ModeSymlink) == 0 {
+			continue
+		}
+		if err := remove(ctx, fs, dev); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// removeEmptyTPG removes a TPG without LUNs, and its target if that was its
+// last TPG.
+func removeEmptyTPG(ctx context.Context, fs FS, tpg string) error {
+	if strings.HasPrefix(tpg, iscsiDir+"/") {
+		return removeTPG(ctx, fs, tpg)
+	}
+	if err := remove(ctx, fs, tpg); err != nil {
+		return err
+	}
+	target := path.Dir(tpg)
+	if others, _ := fs.Glob(path.Join(target, "tpgt_*")); len(others) > 0 {
+		return nil
+	}
+	return remove(ctx, fs, target)
+}
@@ -10,7 +10,8 @@ import (
 )
 
 // SCSICmdHandler is a simple request/response handler for SCSI commands coming to TCMU.
-// A SCSI error is reported as an SCSIResponse with an error bit set, while returning a Go error is for flagrant, process-ending errors (OOM, perhaps).
+// A SCSI error is reported as an SCSIResponse with an error bit set, while returning a Go error is for flagrant errors (OOM, perhaps):
+// the command fails with a hardware error, the handler's OnFatal is told, and, if FenceOnError is set, the device is fenced.
 type SCSICmdHandler interface {
 	HandleCommand(cmd *SCSICmd) (SCSIResponse, error)
 }
@@ -52,6 +53,10 @@ func (h ReadWriterAtCmdHandler) HandleCommand(cmd *SCSICmd) (SCSIResponse, error
 		return EmulateRead(cmd, h.RW)
 	case scsi.Write6, scsi.Write10, scsi.Write12, scsi.Write16:
 		return EmulateWrite(cmd, h.RW)
+	case scsi.MaintenanceIn:
+		return EmulateMaintenanceIn(cmd)
+	case scsi.MaintenanceOut:
+		return EmulateMaintenanceOut(cmd)
 	default:
 		log.Debugf("Ignore unknown SCSI command 0x%x\n", cmd.Command())
 	}
@@ -90,7 +95,8 @@ func EmulateStdInquiry(cmd *SCSICmd, inq *InquiryInfo) (SCSIResponse, error) {
 	productRev := FixedString(inq.ProductRev, 4)
 	copy(buf[32:36], productRev)
 
-	buf[4] = 31 // Set additional length to 31
+	buf[5] = cmd.Device().tpgs() // TPGS, if the device has ALUA groups
+	buf[4] = 31                  // Set additional length to 31
 	_, err := cmd.Write(buf)
 	if err != nil {
 		return SCSIResponse{}, err
@@ -174,6 +180,24 @@ func EmulateEvpdInquiry(cmd *SCSICmd, inq *InquiryInfo) (SCSIResponse, error) {
 		used += n + 1 + 4
 
 		order := binary.BigEndian
+		if port, group, ok := cmd.Device().aluaPort(); ok {
+			// Relative target port, then target port group, both
+			// associated with the target port.
+			ptr = data[used:]
+			ptr[0] = 1 // code set: binary
+			ptr[1] = 0x14
+			ptr[3] = 4
+			order.PutUint16(ptr[6:8], port)
+			used += 8
+
+			ptr = data[used:]
+			ptr[0] = 1 // code set: binary
+			ptr[1] = 0x15
+			ptr[3] = 4
+			order.PutUint16(ptr[6:8], group)
+			used += 8
+		}
+
 		order.PutUint16(data[2:4], uint16(used-4))
 
 		cmd.Write(data[:used])
@@ -319,17 +343,46 @@ func EmulateModeSelect(cmd *SCSICmd, wce bool) (SCSIResponse, error) {
 	return cmd.Ok(), nil
 }
 
-func EmulateRead(cmd *SCSICmd, r io.ReaderAt) (SCSIResponse, error) {
-	offset := cmd.LBA() * uint64(cmd.Device().Sizes().BlockSize)
-	length := int(cmd.XferLen() * uint32(cmd.Device().Sizes().BlockSize))
-	if cmd.Buf == nil {
-		cmd.Buf = make([]byte, length)
+// mediaRange returns the byte offset and length a read or write command
+// covers. If the command is out of range, or asks to move more data than the
+// kernel provided room for, ok is false and resp fails it. A command moving no
+// blocks is fine, and resp is then its success.
+func mediaRange(cmd *SCSICmd) (offset int64, length int, resp SCSIResponse, ok bool) {
+	if resp, ok := CheckLBARange(cmd); !ok {
+		return 0, 0, resp, false
+	}
+	blockSize := uint64(cmd.Device().Sizes().BlockSize)
+	n := uint64(cmd.XferLen()) * blockSize
+	if n == 0 {
+		return 0, 0, cmd.Ok(), true
 	}
-	if len(cmd.Buf) < int(length) {
-		//realloc
-		cmd.Buf = make([]byte, length)
+	if n > uint64(cmd.dataLen()) {
+		log.Errorf("SCSI command 0x%x wants %d bytes, but has room for %d", cmd.Command(), n, cmd.dataLen())
+		return 0, 0, cmd.IllegalRequest(), false
 	}
-	n, err := r.ReadAt(cmd.Buf[:length], int64(offset))
+	return int64(cmd.LBA() * blockSize), int(n), SCSIResponse{}, true
+}
+
+// EmulateRead reads the command's blocks from r. If r is a VectorReaderAt, or
+// an *os.File, they are read straight into the kernel's data area; otherwise
+// they are copied through cmd.Buf, or a buffer from the device's pool if Buf
+// is too small.
+func EmulateRead(cmd *SCSICmd, r io.ReaderAt) (SCSIResponse, error) {
+	offset, length, resp, ok := mediaRange(cmd)
+	if !ok || length == 0 {
+		return resp, nil
+	}
+	if vr := vectorReader(r); vr != nil {
+		// Read straight into the data area.
+		if _, err := vr.ReadvAt(cmd.iovecs(length), offset); err != nil {
+			log.Errorln("read failed: error:", err)
+			return cmd.MediumError(), nil
+		}
+		return cmd.Ok(), nil
+	}
+	buf, done := cmd.scratch(length)
+	defer done()
+	n, err := r.ReadAt(buf, int64(offset))
 	if n < length {
 		log.Errorln("read/read failed: unable to copy enough")
 		return cmd.MediumError(), nil
@@ -338,7 +391,7 @@ func EmulateRead(cmd *SCSICmd, r io.ReaderAt) (SCSIResponse, error) {
 		log.Errorln("read/read failed: error:", err)
 		return cmd.MediumError(), nil
 	}
-	n, err = cmd.Write(cmd.Buf[:length])
+	n, err = cmd.Write(buf)
 	if n < length {
 		log.Errorln("read/write failed: unable to copy enough")
 		return cmd.MediumError(), nil
@@ -350,17 +403,25 @@ func EmulateRead(cmd *SCSICmd, r io.ReaderAt) (SCSIResponse, error) {
 	return cmd.Ok(), nil
 }
 
+// EmulateWrite writes the command's blocks to r, straight from the kernel's
+// data area if r is a VectorWriterAt or an *os.File, and through cmd.Buf or a
+// pooled buffer otherwise.
 func EmulateWrite(cmd *SCSICmd, r io.WriterAt) (SCSIResponse, error) {
-	offset := cmd.LBA() * uint64(cmd.Device().Sizes().BlockSize)
-	length := int(cmd.XferLen() * uint32(cmd.Device().Sizes().BlockSize))
-	if cmd.Buf == nil {
-		cmd.Buf = make([]byte, length)
-	}
-	if len(cmd.Buf) < int(length) {
-		//realloc
-		cmd.Buf = make([]byte, length)
+	offset, length, resp, ok := mediaRange(cmd)
+	if !ok || length == 0 {
+		return resp, nil
+	}
+	if vw := vectorWriter(r); vw != nil {
+		// Write straight from the data area.
+		if _, err := vw.WritevAt(cmd.iovecs(length), offset); err != nil {
+			log.Errorln("write failed: error:", err)
+			return cmd.MediumError(), nil
+		}
+		return cmd.Ok(), nil
 	}
-	n, err := cmd.Read(cmd.Buf[:int(length)])
+	buf, done := cmd.scratch(length)
+	defer done()
+	n, err := cmd.Read(buf)
 	if n < length {
 		log.Errorln("write/read failed: unable to copy enough")
 		return cmd.MediumError(), nil
@@ -369,7 +430,7 @@ func EmulateWrite(cmd *SCSICmd, r io.WriterAt) (SCSIResponse, error) {
 		log.Errorln("write/read failed: error:", err)
 		return cmd.MediumError(), nil
 	}
-	n, err = r.WriteAt(cmd.Buf[:length], int64(offset))
+	n, err = r.WriteAt(buf, int64(offset))
 	if n < length {
 		log.Errorln("write/write failed: unable to copy enough")
 		return cmd.MediumError(), nil
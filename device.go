@@ -3,13 +3,14 @@
 package tcmu
 
 import (
+	"context"
 	"fmt"
-	"io/ioutil"
 	"os"
 	"path"
 	"path/filepath"
 	"strconv"
 	"strings"
+	"sync"
 	"syscall"
 	"time"
 
@@ -22,21 +23,64 @@ import (
 const (
 	configDirFmt = "/sys/kernel/config/target/core/user_%d"
 	scsiDir      = "/sys/kernel/config/target/loopback"
+	vhostDir     = "/sys/kernel/config/target/vhost"
+
+	scsiDevicesDir = "/sys/bus/scsi/devices"
+	uioClassDir    = "/sys/class/uio"
+
+	// devEntryTimeout bounds the wait for the kernel to create the block
+	// device, and removeTimeout each configfs removal, whatever the context.
+	devEntryTimeout = 30 * time.Second
+	removeTimeout   = 30 * time.Second
 )
 
 type Device struct {
+	// stats comes first, as its 64 bit counters are used atomically and
+	// must be 8 byte aligned on 32 bit platforms.
+	stats deviceStats
+
 	scsi    *SCSIHandler
 	devPath string
+	fs      FS
 
 	hbaDir     string
 	deviceName string
 
 	uioFd    int
+	epollFd  int
+	eventFd  int
 	mapsize  uint64
 	mmap     []byte
 	cmdChan  chan *SCSICmd
 	respChan chan SCSIResponse
 	cmdTail  uint32
+	pollDone chan struct{}
+	respDone chan struct{}
+	respStop chan struct{}
+
+	mu       sync.Mutex
+	inflight map[uint16]InFlightCommand
+	drained  chan struct{}
+	// timedOut is set once a drain has given up waiting, and forced once
+	// the commands it left behind have been failed.
+	timedOut bool
+	forced   bool
+	fenced   *HandlerError
+	nexus    Nexus
+
+	// sizesMu guards scsi.DataSizes, which a netlink reconfiguration can
+	// change while commands are being handled.
+	sizesMu sync.RWMutex
+
+	alua *aluaState
+
+	// buffers are the workers' scratch buffers.
+	buffers *bufferPool
+	// workers run CmdHandler, if the handler has no DevReady.
+	workers *workerPool
+
+	// blockDev is the loopback LUN's disk, once it has been found.
+	blockDev *blockDevice
 }
 
 // WWN provides two WWNs, one for the device itself and one for the loopback
@@ -51,55 +95,154 @@ func (d *Device) GetDevConfig() string {
 }
 
 func (d *Device) Sizes() DataSizes {
+	d.sizesMu.RLock()
+	defer d.sizesMu.RUnlock()
 	return d.scsi.DataSizes
 }
 
 // OpenTCMUDevice creates the virtual device based on the details in the SCSIHandler, eventually creating a device under devPath (eg, "/dev") with the file name scsi.VolumeName.
 // The returned Device represents the open device connection to the kernel, and must be closed.
 func OpenTCMUDevice(devPath string, scsi *SCSIHandler) (*Device, error) {
-	d := &Device{
-		scsi:    scsi,
-		devPath: devPath,
-		uioFd:   -1,
-		hbaDir:  fmt.Sprintf(configDirFmt, scsi.HBA),
-	}
-	err := d.Close()
+	return OpenTCMUDeviceContext(context.Background(), devPath, scsi)
+}
+
+// OpenTCMUDeviceContext is OpenTCMUDevice, but gives up as soon as ctx is
+// cancelled or its deadline passes. Any error is a *StepError naming the step
+// that failed; whatever was set up before it is torn down again.
+func OpenTCMUDeviceContext(ctx context.Context, devPath string, scsi *SCSIHandler) (*Device, error) {
+	d := newDevice(devPath, scsi)
+	err := d.Shutdown(ctx)
 	if err != nil {
 		return nil, err
 	}
+	if scsi.Netlink != nil {
+		scsi.Netlink.register(d)
+	}
 	if err := d.preEnableTcmu(); err != nil {
-		return nil, err
+		return nil, d.abort(stepError(StepConfigfs, err))
 	}
 	if err := d.start(); err != nil {
-		return nil, err
+		return nil, d.abort(stepError(StepUIO, err))
+	}
+	if err := d.postEnableTcmu(ctx); err != nil {
+		return nil, d.abort(err)
 	}
+	return d, nil
+}
+
+func newDevice(devPath string, scsi *SCSIHandler) *Device {
+	fs := scsi.FS
+	if fs == nil {
+		fs = OSFS{}
+	}
+	return &Device{
+		scsi:    scsi,
+		devPath: devPath,
+		fs:      fs,
+		uioFd:   -1,
+		epollFd: -1,
+		eventFd: -1,
+		hbaDir:  fmt.Sprintf(configDirFmt, scsi.HBA),
+		alua:    newALUAState(scsi.ALUAGroups),
+	}
+}
 
-	return d, d.postEnableTcmu()
+// abort tears down a partially opened device and returns err. The teardown
+// gets its own deadline, since the caller's context may be why we're here.
+func (d *Device) abort(err error) error {
+	ctx, cancel := context.WithTimeout(context.Background(), removeTimeout)
+	defer cancel()
+	if cerr := d.Shutdown(ctx); cerr != nil {
+		logrus.Errorf("Failed to clean up %s: %v", d.scsi.VolumeName, cerr)
+	}
+	return err
 }
 
+// Close shuts the device down. It is Shutdown without a deadline.
 func (d *Device) Close() error {
-	err := d.teardown()
-	if err != nil {
+	return d.Shutdown(context.Background())
+}
+
+// Shutdown shuts the device down. The fabric is unlinked first, while commands
+// are still being served, so that the kernel can flush whatever it has
+// outstanding. The device then stops accepting commands and waits, for at
+// most the handler's DrainTimeout, for those in flight. Polling is then
+// stopped, and only then is the ring unmapped and the backstore removed.
+//
+// If commands are still in flight when the drain phase ends, or when ctx is
+// done during it, Shutdown returns a *DrainError listing them. If ctx is done
+// in a later step, it returns a *StepError. Either way the device is left
+// where it got to, and calling Shutdown again picks up from there; after a
+// *DrainError, that fails the leftover commands rather than waiting again.
+func (d *Device) Shutdown(ctx context.Context) error {
+	if err := d.teardownFabric(ctx); err != nil {
 		return err
 	}
-	if d.uioFd != -1 {
-		unix.Close(d.uioFd)
+	if err := d.drain(ctx); err != nil {
+		return err
+	}
+	if err := d.stopPoll(ctx); err != nil {
+		return stepError(StepUIO, err)
+	}
+	d.unmap()
+	if err := d.teardownBackstore(ctx); err != nil {
+		return stepError(StepConfigfs, err)
+	}
+	// The kernel waits for a reply to its REMOVED event before the backstore
+	// goes, so only stop listening for it now.
+	if d.scsi.Netlink != nil {
+		d.scsi.Netlink.unregister(d)
 	}
 	return nil
 }
 
+func (d *Device) unmap() {
+	if d.mmap != nil {
+		if err := unix.Munmap(d.mmap); err != nil {
+			logrus.Errorf("Failed to unmap %s: %v", d.deviceName, err)
+		}
+		d.mmap = nil
+	}
+	for _, fd := range []*int{&d.epollFd, &d.eventFd, &d.uioFd} {
+		if *fd != -1 {
+			unix.Close(*fd)
+			*fd = -1
+		}
+	}
+}
+
 func (d *Device) preEnableTcmu() error {
-	err := writeLines(path.Join(d.hbaDir, d.scsi.VolumeName, "control"), []string{
+	control := []string{
 		fmt.Sprintf("dev_size=%d", d.scsi.DataSizes.VolumeSize),
 		fmt.Sprintf("dev_config=%s", d.GetDevConfig()),
 		fmt.Sprintf("hw_block_size=%d", d.scsi.DataSizes.BlockSize),
 		"async=1",
-	})
+	}
+	err := writeLines(d.fs, path.Join(d.hbaDir, d.scsi.VolumeName, "control"), control)
 	if err != nil {
 		return err
 	}
 
-	return writeLines(path.Join(d.hbaDir, d.scsi.VolumeName, "enable"), []string{
+	attrControl, err := d.applyAttributes(d.attributes())
+	if err != nil {
+		return err
+	}
+	if len(attrControl) > 0 {
+		err := writeLines(d.fs, path.Join(d.hbaDir, d.scsi.VolumeName, "control"), attrControl)
+		if err != nil {
+			return err
+		}
+	}
+
+	// Ask for TMR entries in the ring, where the kernel can send them.
+	tmrAttr := path.Join(d.hbaDir, d.scsi.VolumeName, tmrNotificationAttr)
+	if _, err := d.fs.Stat(tmrAttr); err == nil {
+		if err := writeLines(d.fs, tmrAttr, []string{"1"}); err != nil {
+			return err
+		}
+	}
+
+	return writeLines(d.fs, path.Join(d.hbaDir, d.scsi.VolumeName, "enable"), []string{
 		"1",
 	})
 }
@@ -112,109 +255,318 @@ func (d *Device) getLunPath(prefix string) string {
 	return path.Join(prefix, "lun", fmt.Sprintf("lun_%d", d.scsi.LUN))
 }
 
-func (d *Device) postEnableTcmu() error {
+func (d *Device) postEnableTcmu(ctx context.Context) error {
+	if err := d.createALUAGroups(); err != nil {
+		return stepError(StepConfigfs, err)
+	}
+	if err := d.fabric().Export(ctx, d); err != nil {
+		return stepError(StepFabric, err)
+	}
+	if err := d.joinALUAGroups(); err != nil {
+		return stepError(StepFabric, err)
+	}
+	d.resolveNexus()
+	return nil
+}
+
+// Fabric exports the TCMU backstore to initiators through one of LIO's
+// target fabrics.
+type Fabric interface {
+	// Export links the backstore into the fabric. It is also used when
+	// attaching to a running device, so it should leave alone whatever is
+	// already in place.
+	Export(ctx context.Context, d *Device) error
+	// Unexport removes what Export created. It is also used to clean up
+	// before exporting, so it must succeed when there is nothing to remove.
+	Unexport(ctx context.Context, d *Device) error
+}
+
+func (d *Device) fabric() Fabric {
+	if d.scsi.Fabric == nil {
+		return LoopbackFabric{}
+	}
+	return d.scsi.Fabric
+}
+
+// BackstorePath is the device's directory in configfs, which fabrics link
+// their LUNs to.
+func (d *Device) BackstorePath() string {
+	return path.Join(d.hbaDir, d.scsi.VolumeName)
+}
+
+// LoopbackFabric exports the device through the loopback fabric, so that it
+// shows up on this host as a SCSI disk, and creates a node for it under the
+// device path. The loopback target is named by the handler's WWN. This is the
+// default fabric.
+//
+// The entry under the device path is replaced whenever the device is opened
+// or attached, so it can't be left pointing at a disk the kernel has since
+// renumbered.
+type LoopbackFabric struct {
+	// Symlink makes the entry a symlink to the kernel's own node, eg
+	// /dev/sdb, instead of a device node.
+	Symlink bool
+	// Mode is the permission bits of the device node, or of the kernel's
+	// node in Symlink mode. Zero means 0600 for a device node, and leaves
+	// the kernel's node as udev made it.
+	Mode os.FileMode
+	// UID and GID, if set, are the owner of the device node, or of the
+	// kernel's node in Symlink mode. A nil one is left as it is.
+	UID, GID *int
+}
+
+// LUNPath is the configfs directory of the device's loopback LUN.
+func (LoopbackFabric) LUNPath(d *Device) string {
+	prefix, _ := d.getSCSIPrefixAndWnn()
+	return d.getLunPath(prefix)
+}
+
+// Nexus is the loopback TPG's nexus, whose initiator port is the kernel's
+// own.
+func (LoopbackFabric) Nexus(d *Device) Nexus {
 	prefix, nexusWnn := d.getSCSIPrefixAndWnn()
+	return Nexus{
+		Fabric:    "loopback",
+		Initiator: readNexus(d.fs, prefix, nexusWnn),
+		Target:    d.scsi.WWN.DeviceID(),
+		TPG:       1,
+	}
+}
+
+func (f LoopbackFabric) Export(ctx context.Context, d *Device) error {
+	prefix, nexusWnn := d.getSCSIPrefixAndWnn()
+	lunPath := d.getLunPath(prefix)
+	lunLink := path.Join(lunPath, d.scsi.VolumeName)
+	if _, err := d.fs.Lstat(lunLink); err == nil {
+		if err := d.findBlockDevice(ctx, nil); err != nil {
+			return stepError(StepBlockDevice, err)
+		}
+		return stepError(StepBlockDevice, f.createDevEntry(d))
+	}
 
-	err := writeLines(path.Join(prefix, "nexus"), []string{
+	// Start listening before the LUN is linked, so as not to miss the
+	// disk's uevent.
+	hub := d.scsi.uevents
+	if hub == nil {
+		hub = &ueventHub{}
+	}
+	w, err := hub.watch()
+	if err != nil {
+		logrus.Debugf("Not watching uevents, polling sysfs instead: %v", err)
+	}
+	defer w.Close()
+
+	err = writeLines(d.fs, path.Join(prefix, "nexus"), []string{
 		nexusWnn,
 	})
 	if err != nil {
-		return err
+		return stepError(StepNexus, err)
 	}
 
-	lunPath := d.getLunPath(prefix)
 	logrus.Debugf("Creating directory: %s", lunPath)
-	if err := os.MkdirAll(lunPath, 0755); err != nil && !os.IsExist(err) {
-		return err
+	if err := d.fs.MkdirAll(lunPath, 0755); err != nil && !os.IsExist(err) {
+		return stepError(StepNexus, err)
 	}
 
-	logrus.Debugf("Linking: %s => %s", path.Join(lunPath, d.scsi.VolumeName), path.Join(d.hbaDir, d.scsi.VolumeName))
-	if err := os.Symlink(path.Join(d.hbaDir, d.scsi.VolumeName), path.Join(lunPath, d.scsi.VolumeName)); err != nil {
-		return err
+	logrus.Debugf("Linking: %s => %s", lunLink, d.BackstorePath())
+	if err := d.fs.Symlink(d.BackstorePath(), lunLink); err != nil {
+		return stepError(StepNexus, err)
 	}
 
-	return d.createDevEntry()
+	if err := d.findBlockDevice(ctx, w); err != nil {
+		return stepError(StepBlockDevice, err)
+	}
+	return stepError(StepBlockDevice, f.createDevEntry(d))
 }
 
-func (d *Device) createDevEntry() error {
-	os.MkdirAll(d.devPath, 0755)
-
+func (LoopbackFabric) Unexport(ctx context.Context, d *Device) error {
 	dev := filepath.Join(d.devPath, d.scsi.VolumeName)
+	tpgtPath, _ := d.getSCSIPrefixAndWnn()
+	lunPath := d.getLunPath(tpgtPath)
 
-	if _, err := os.Stat(dev); err == nil {
-		return fmt.Errorf("Device %s already exists, can not create", dev)
+	/*
+		We're removing:
+		/sys/kernel/config/target/loopback/naa.<id>/tpgt_1/lun/lun_0/<volume name>
+		/sys/kernel/config/target/loopback/naa.<id>/tpgt_1/lun/lun_0
+		/sys/kernel/config/target/loopback/naa.<id>/tpgt_1
+		/sys/kernel/config/target/loopback/naa.<id>
+	*/
+	pathsToRemove := []string{
+		path.Join(lunPath, d.scsi.VolumeName),
+		lunPath,
+		tpgtPath,
+		path.Dir(tpgtPath),
 	}
 
-	tgt, _ := d.getSCSIPrefixAndWnn()
-
-	address, err := ioutil.ReadFile(path.Join(tgt, "address"))
-	if err != nil {
-		return err
+	for _, p := range pathsToRemove {
+		err := remove(ctx, d.fs, p)
+		if err != nil {
+			return stepError(StepNexus, err)
+		}
 	}
 
-	found := false
-	matches := []string{}
-	path := fmt.Sprintf("/sys/bus/scsi/devices/%s*/block/*/dev", strings.TrimSpace(string(address)))
-	for i := 0; i < 30; i++ {
-		var err error
-		matches, err = filepath.Glob(path)
-		if len(matches) > 0 && err == nil {
-			found = true
-			break
+	// Should be cleaned up automatically, but if it isn't remove it
+	if _, err := d.fs.Lstat(dev); err == nil {
+		err := remove(ctx, d.fs, dev)
+		if err != nil {
+			return stepError(StepBlockDevice, err)
 		}
-
-		logrus.Debugf("Waiting for %s", path)
-		time.Sleep(1 * time.Second)
 	}
 
-	if !found {
-		return fmt.Errorf("Failed to find %s", path)
+	return nil
+}
+
+// VhostFabric exports the device through vhost-scsi, for a local QEMU/KVM
+// guest to use as a virtio-scsi disk. No node is created under the device
+// path: the guest sees the device, the host doesn't. Several devices may share
+// one WWPN, each as its own LUN (the handler's LUN).
+type VhostFabric struct {
+	// WWPN names the vhost target, eg "naa.5001405abcdef012". Empty means
+	// the handler's WWN device ID.
+	WWPN string
+}
+
+func (f VhostFabric) wwpn(d *Device) string {
+	if f.WWPN == "" {
+		return d.scsi.WWN.DeviceID()
 	}
+	return f.WWPN
+}
 
-	if len(matches) == 0 {
-		return fmt.Errorf("Failed to find %s", path)
+// VhostWWPN returns the WWPN the device is exported under, to pass to QEMU as
+// -device vhost-scsi-pci,wwpn=<WWPN>. It is empty unless the handler's fabric
+// is a VhostFabric.
+func (d *Device) VhostWWPN() string {
+	if f, ok := d.fabric().(VhostFabric); ok {
+		return f.wwpn(d)
 	}
+	return ""
+}
+
+// LUNPath is the configfs directory of the device's vhost LUN.
+func (f VhostFabric) LUNPath(d *Device) string {
+	return d.getLunPath(path.Join(vhostDir, f.wwpn(d), "tpgt_1"))
+}
 
-	if len(matches) > 1 {
-		return fmt.Errorf("Too many matches for %s, found %d", path, len(matches))
+// Nexus is the vhost TPG's nexus, the guest's only way in.
+func (f VhostFabric) Nexus(d *Device) Nexus {
+	return Nexus{
+		Fabric:    "vhost",
+		Initiator: readNexus(d.fs, path.Join(vhostDir, f.wwpn(d), "tpgt_1"), d.scsi.WWN.NexusID()),
+		Target:    f.wwpn(d),
+		TPG:       1,
 	}
+}
 
-	majorMinor, err := ioutil.ReadFile(matches[0])
-	if err != nil {
+func (f VhostFabric) Export(ctx context.Context, d *Device) error {
+	tpgtPath := path.Join(vhostDir, f.wwpn(d), "tpgt_1")
+	lunPath := d.getLunPath(tpgtPath)
+
+	logrus.Debugf("Creating directory: %s", lunPath)
+	if err := d.fs.MkdirAll(lunPath, 0755); err != nil && !os.IsExist(err) {
 		return err
 	}
-
-	parts := strings.Split(strings.TrimSpace(string(majorMinor)), ":")
-	if len(parts) != 2 {
-		return fmt.Errorf("Invalid major:minor string %s", string(majorMinor))
+	// The nexus can only be set once. Until it is, reading it fails with
+	// ENODEV, so any error is taken to mean there's none yet.
+	nexus, err := d.fs.ReadFile(path.Join(tpgtPath, "nexus"))
+	if err != nil || strings.TrimSpace(string(nexus)) == "" {
+		if err := writeLines(d.fs, path.Join(tpgtPath, "nexus"), []string{d.scsi.WWN.NexusID()}); err != nil {
+			return err
+		}
 	}
+	return symlinkOnce(d.fs, d.BackstorePath(), path.Join(lunPath, d.scsi.VolumeName))
+}
 
-	major, err := strconv.Atoi(parts[0])
-	if err != nil {
-		return err
+func (f VhostFabric) Unexport(ctx context.Context, d *Device) error {
+	tpgtPath := path.Join(vhostDir, f.wwpn(d), "tpgt_1")
+	lunPath := d.getLunPath(tpgtPath)
+
+	/*
+		We're removing:
+		/sys/kernel/config/target/vhost/naa.<id>/tpgt_1/lun/lun_0/<volume name>
+		/sys/kernel/config/target/vhost/naa.<id>/tpgt_1/lun/lun_0
+		and, if that was the last LUN:
+		/sys/kernel/config/target/vhost/naa.<id>/tpgt_1
+		/sys/kernel/config/target/vhost/naa.<id>
+		The kernel refuses to remove the TPG while a guest is using it.
+	*/
+	for _, p := range []string{path.Join(lunPath, d.scsi.VolumeName), lunPath} {
+		if err := remove(ctx, d.fs, p); err != nil {
+			return err
+		}
 	}
-	minor, err := strconv.Atoi(parts[1])
-	if err != nil {
+	if luns, err := d.fs.ReadDir(path.Join(tpgtPath, "lun")); err != nil || len(luns) > 0 {
+		return nil
+	}
+	for _, p := range []string{tpgtPath, path.Dir(tpgtPath)} {
+		if err := remove(ctx, d.fs, p); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// createDevEntry creates the entry for the block device under the device
+// path. It is made under a temporary name and renamed into place, replacing
+// whatever was there before, such as a node left behind by a crash.
+func (f LoopbackFabric) createDevEntry(d *Device) error {
+	d.fs.MkdirAll(d.devPath, 0755)
+
+	dev := filepath.Join(d.devPath, d.scsi.VolumeName)
+	tmp := dev + ".tmp"
+	if err := d.fs.Remove(tmp); err != nil && !os.IsNotExist(err) {
 		return err
 	}
 
-	logrus.Debugf("Creating device %s %d:%d", dev, major, minor)
-	return mknod(dev, major, minor)
+	mode := f.Mode
+	node := tmp
+	if f.Symlink {
+		node = d.BlockDevicePath()
+		logrus.Debugf("Linking: %s => %s", dev, node)
+		if err := d.fs.Symlink(node, tmp); err != nil {
+			return err
+		}
+	} else {
+		if mode == 0 {
+			mode = 0600
+		}
+		major, minor := d.BlockDeviceNumber()
+		logrus.Debugf("Creating device %s %d:%d", dev, major, minor)
+		if err := mknod(d.fs, tmp, mode, major, minor); err != nil {
+			return err
+		}
+	}
+	if mode != 0 {
+		if err := d.fs.Chmod(node, mode); err != nil {
+			d.fs.Remove(tmp)
+			return err
+		}
+	}
+	uid, gid := -1, -1
+	if f.UID != nil {
+		uid = *f.UID
+	}
+	if f.GID != nil {
+		gid = *f.GID
+	}
+	if uid != -1 || gid != -1 {
+		if err := d.fs.Chown(node, uid, gid); err != nil {
+			d.fs.Remove(tmp)
+			return err
+		}
+	}
+	return d.fs.Rename(tmp, dev)
 }
 
-func mknod(device string, major, minor int) error {
-	var fileMode os.FileMode = 0600
-	fileMode |= syscall.S_IFBLK
-	dev := int((major << 8) | (minor & 0xff) | ((minor & 0xfff00) << 12))
-
-	return syscall.Mknod(device, uint32(fileMode), dev)
+func mknod(fs FS, device string, mode os.FileMode, major, minor uint32) error {
+	return fs.Mknod(device, uint32(mode.Perm())|syscall.S_IFBLK, int(unix.Mkdev(major, minor)))
 }
 
-func writeLines(target string, lines []string) error {
+func writeLines(fs FS, target string, lines []string) error {
 	dir := path.Dir(target)
-	if stat, err := os.Stat(dir); os.IsNotExist(err) {
+	if stat, err := fs.Stat(dir); os.IsNotExist(err) {
 		logrus.Debugf("Creating directory: %s", dir)
-		if err := os.MkdirAll(dir, 0755); err != nil {
+		if err := fs.MkdirAll(dir, 0755); err != nil {
 			return err
 		}
 	} else if !stat.IsDir() {
@@ -224,7 +576,7 @@ func writeLines(target string, lines []string) error {
 	for _, line := range lines {
 		content := []byte(line + "\n")
 		logrus.Debugf("Setting %s: %s", target, line)
-		if err := ioutil.WriteFile(target, content, 0755); err != nil {
+		if err := fs.WriteFile(target, content, 0755); err != nil {
 			logrus.Errorf("Failed to write %s to %s: %v", line, target, err)
 			return err
 		}
@@ -238,61 +590,79 @@ func (d *Device) start() (err error) {
 	if err != nil {
 		return
 	}
-	d.cmdChan = make(chan *SCSICmd, 5)
-	d.respChan = make(chan SCSIResponse, 5)
-	go d.beginPoll()
-	d.scsi.DevReady(d.cmdChan, d.respChan)
+	return d.serve()
+}
+
+// serve starts the handler, then polls the command ring of the open UIO device
+// and hands the commands to it.
+func (d *Device) serve() (err error) {
+	devReady := d.scsi.DevReady
+	depth := d.queueDepth()
+	if devReady == nil {
+		if d.scsi.CmdHandler == nil {
+			return fmt.Errorf("tcmu: handler for %s has neither DevReady nor CmdHandler", d.scsi.VolumeName)
+		}
+		d.workers = newWorkerPool(d.scsi.CmdHandler, d.scsi.MinWorkers, d.scsi.MaxWorkers, depth)
+		devReady = d.workers.devReady
+	}
+	// The kernel never has more than depth commands outstanding.
+	d.cmdChan = make(chan *SCSICmd, depth)
+	d.respChan = make(chan SCSIResponse, depth)
+	// The handler is started before polling, so that if it fails there is
+	// nothing running to stop: the response channel may be its to close, and
+	// the caller's abort tears the rest down.
+	if err = devReady(d.cmdChan, d.respChan); err != nil {
+		return
+	}
+	if err = d.startPoll(); err != nil {
+		// No commands are coming; let the handler wind down.
+		close(d.cmdChan)
+	}
 	return
 }
 
 func (d *Device) findDevice() error {
-	err := filepath.Walk("/dev", func(path string, i os.FileInfo, err error) error {
-		if err != nil {
-			return err
-		}
-		if i.IsDir() && path != "/dev" {
-			return filepath.SkipDir
+	entries, err := d.fs.ReadDir(devRoot)
+	if err != nil {
+		return err
+	}
+	for _, i := range entries {
+		if i.IsDir() || !strings.HasPrefix(i.Name(), "uio") {
+			continue
 		}
-		if !strings.HasPrefix(i.Name(), "uio") {
-			return nil
+		sysfile := path.Join(uioClassDir, i.Name(), "name")
+		bytes, err := d.fs.ReadFile(sysfile)
+		if os.IsNotExist(err) {
+			// Another device went away while we were looking.
+			continue
 		}
-		sysfile := fmt.Sprintf("/sys/class/uio/%s/name", i.Name())
-		bytes, err := ioutil.ReadFile(sysfile)
 		if err != nil {
 			return err
 		}
 		split := strings.SplitN(strings.TrimRight(string(bytes), "\n"), "/", 4)
-		if split[0] != "tcm-user" {
+		if split[0] != "tcm-user" || len(split) < 4 {
 			// Not a TCM device
 			log.Debugf("%s is not a tcm-user device", i.Name())
-			return nil
+			continue
 		}
 		if split[3] != d.GetDevConfig() {
 			// Not a TCM device
 			log.Debugf("%s is not our tcm-user device", i.Name())
-			return nil
+			continue
 		}
-		err = d.openDevice(split[1], split[2], i.Name())
-		if err != nil {
-			return err
-		}
-		return filepath.SkipDir
-	})
-	if err == filepath.SkipDir {
-		return nil
+		return d.openDevice(split[1], split[2], i.Name())
 	}
-	return err
+	return fmt.Errorf("No UIO device found for %s", d.GetDevConfig())
 }
 
 func (d *Device) openDevice(user string, vol string, uio string) error {
 	var err error
 	d.deviceName = vol
-	//d.uioFd, err = syscall.Open(fmt.Sprintf("/dev/%s", uio), syscall.O_RDWR|syscall.O_NONBLOCK|syscall.O_CLOEXEC, 0600)
-	d.uioFd, err = syscall.Open(fmt.Sprintf("/dev/%s", uio), syscall.O_RDWR|syscall.O_CLOEXEC, 0600)
+	d.uioFd, err = d.fs.Open(path.Join(devRoot, uio), syscall.O_RDWR|syscall.O_NONBLOCK|syscall.O_CLOEXEC, 0600)
 	if err != nil {
 		return err
 	}
-	bytes, err := ioutil.ReadFile(fmt.Sprintf("/sys/class/uio/%s/maps/map0/size", uio))
+	bytes, err := d.fs.ReadFile(path.Join(uioClassDir, uio, "maps/map0/size"))
 	if err != nil {
 		return err
 	}
@@ -301,9 +671,19 @@ func (d *Device) openDevice(user string, vol string, uio string) error {
 		return err
 	}
 	d.mmap, err = syscall.Mmap(d.uioFd, 0, int(d.mapsize), syscall.PROT_READ|syscall.PROT_WRITE, syscall.MAP_SHARED)
+	if err != nil {
+		return err
+	}
 	d.cmdTail = d.mbCmdTail()
+	d.buffers = newBufferPool(d.dataAreaSize())
 	d.debugPrintMb()
-	return err
+	return nil
+}
+
+// dataAreaSize returns the size of the data area, which follows the command
+// ring in the mapping.
+func (d *Device) dataAreaSize() int {
+	return int(d.mapsize) - int(d.mbCmdrOffset()+d.mbCmdrSize())
 }
 
 func (d *Device) debugPrintMb() {
@@ -316,62 +696,44 @@ func (d *Device) debugPrintMb() {
 	log.Debugf("mbCmdTail: %d\n", d.mbCmdTail())
 }
 
-func (d *Device) teardown() error {
-	dev := filepath.Join(d.devPath, d.scsi.VolumeName)
-	tpgtPath, _ := d.getSCSIPrefixAndWnn()
-	lunPath := d.getLunPath(tpgtPath)
-
-	/*
-		We're removing:
-		/sys/kernel/config/target/loopback/naa.<id>/tpgt_1/lun/lun_0/<volume name>
-		/sys/kernel/config/target/loopback/naa.<id>/tpgt_1/lun/lun_0
-		/sys/kernel/config/target/loopback/naa.<id>/tpgt_1
-		/sys/kernel/config/target/loopback/naa.<id>
-		/sys/kernel/config/target/core/user_42/<volume name>
-	*/
-	pathsToRemove := []string{
-		path.Join(lunPath, d.scsi.VolumeName),
-		lunPath,
-		tpgtPath,
-		path.Dir(tpgtPath),
-		path.Join(d.hbaDir, d.scsi.VolumeName),
-	}
-
-	for _, p := range pathsToRemove {
-		err := remove(p)
-		if err != nil {
-			return err
-		}
-	}
+func (d *Device) teardownFabric(ctx context.Context) error {
+	return stepError(StepFabric, d.fabric().Unexport(ctx, d))
+}
 
-	// Should be cleaned up automatically, but if it isn't remove it
-	if _, err := os.Stat(dev); err == nil {
-		err := remove(dev)
-		if err != nil {
-			return err
-		}
+// teardownBackstore removes /sys/kernel/config/target/core/user_<HBA>/<volume name>,
+// and its ALUA groups before it. The kernel won't let it go while the UIO
+// device is still open.
+func (d *Device) teardownBackstore(ctx context.Context) error {
+	if err := d.removeALUAGroups(ctx); err != nil {
+		return err
 	}
-
-	return nil
+	return remove(ctx, d.fs, d.BackstorePath())
 }
 
-func removeAsync(path string, done chan<- error) {
+func removeAsync(fs FS, path string, done chan<- error) {
 	logrus.Debugf("Removing: %s", path)
-	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+	if err := fs.Remove(path); err != nil && !os.IsNotExist(err) {
 		logrus.Errorf("Unable to remove: %v", path)
 		done <- err
+		return
 	}
 	logrus.Debugf("Removed: %s", path)
 	done <- nil
 }
 
-func remove(path string) error {
-	done := make(chan error)
-	go removeAsync(path, done)
+// remove removes path, giving up after removeTimeout or once ctx is done.
+// configfs removals can block for as long as the kernel has I/O outstanding.
+func remove(ctx context.Context, fs FS, path string) error {
+	done := make(chan error, 1)
+	go removeAsync(fs, path, done)
+	timer := time.NewTimer(removeTimeout)
+	defer timer.Stop()
 	select {
 	case err := <-done:
 		return err
-	case <-time.After(30 * time.Second):
+	case <-timer.C:
 		return fmt.Errorf("Timeout trying to delete %s.", path)
+	case <-ctx.Done():
+		return fmt.Errorf("Gave up trying to delete %s: %v", path, ctx.Err())
 	}
 }
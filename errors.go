@@ -0,0 +1,98 @@
+package tcmu
+
+import (
+	"fmt"
+
+	"github.com/prometheus/common/log"
+)
+
+// Step names a stage of bringing a Device up or tearing it down.
+type Step string
+
+const (
+	// StepConfigfs covers creating, configuring, enabling and removing the
+	// TCMU backstore under /sys/kernel/config/target/core.
+	StepConfigfs Step = "configfs"
+	// StepUIO covers finding, opening and mapping the UIO device for the
+	// backstore, and polling its command ring.
+	StepUIO Step = "uio"
+	// StepNexus covers the loopback target, its nexus and the LUN link.
+	StepNexus Step = "loopback nexus"
+	// StepFabric covers exporting the backstore through any other fabric.
+	StepFabric Step = "fabric"
+	// StepBlockDevice covers waiting for the kernel's block device and
+	// creating or removing its node under the device path.
+	StepBlockDevice Step = "block device"
+)
+
+// StepError is returned by OpenTCMUDeviceContext and Device.Shutdown to
+// identify the step that failed.
+type StepError struct {
+	Step Step
+	Err  error
+}
+
+func (e *StepError) Error() string {
+	return fmt.Sprintf("tcmu: %s: %v", e.Step, e.Err)
+}
+
+// Unwrap returns the underlying error, which may be the context's error if
+// the step was cancelled or ran out of time.
+func (e *StepError) Unwrap() error {
+	return e.Err
+}
+
+func stepError(step Step, err error) error {
+	if err == nil {
+		return nil
+	}
+	if _, ok := err.(*StepError); ok {
+		return err
+	}
+	return &StepError{Step: step, Err: err}
+}
+
+// HandlerError is the error a fenced device was fenced for.
+type HandlerError struct {
+	Command byte
+	Err     error
+}
+
+func (e *HandlerError) Error() string {
+	return fmt.Sprintf("tcmu: handling SCSI command 0x%02x: %v", e.Command, e.Err)
+}
+
+func (e *HandlerError) Unwrap() error {
+	return e.Err
+}
+
+// handlerFailed deals with an error returned by the handler for cmd: the
+// command fails with a hardware error, the device is fenced if the handler
+// asks for that, and OnFatal hears about it. The worker carries on.
+func (d *Device) handlerFailed(cmd *SCSICmd, err error) SCSIResponse {
+	herr := &HandlerError{Command: cmd.Command(), Err: err}
+	log.Errorln(herr)
+	if d.scsi.FenceOnError {
+		d.mu.Lock()
+		if d.fenced == nil {
+			d.fenced = herr
+		}
+		d.mu.Unlock()
+	}
+	if d.scsi.OnFatal != nil {
+		d.scsi.OnFatal(herr)
+	}
+	return cmd.TargetFailure()
+}
+
+// Fenced returns the handler error the device was fenced for, or nil if it
+// wasn't. A fenced device fails every command with a hardware error, without
+// handing it to the handler.
+func (d *Device) Fenced() error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.fenced == nil {
+		return nil
+	}
+	return d.fenced
+}
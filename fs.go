@@ -0,0 +1,167 @@
+package tcmu
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+)
+
+const (
+	configfsRoot = "/sys/kernel/config"
+	sysfsRoot    = "/sys"
+	devRoot      = "/dev"
+)
+
+// FS is how a Device reaches configfs, sysfs and /dev while provisioning and
+// tearing down. Paths passed in and returned are always the ones the kernel
+// uses, eg "/sys/kernel/config/target/core/user_30"; an implementation is
+// free to find them somewhere else.
+type FS interface {
+	ReadFile(name string) ([]byte, error)
+	WriteFile(name string, data []byte, perm os.FileMode) error
+	MkdirAll(name string, perm os.FileMode) error
+	Remove(name string) error
+	Symlink(oldname, newname string) error
+	Readlink(name string) (string, error)
+	Stat(name string) (os.FileInfo, error)
+	Lstat(name string) (os.FileInfo, error)
+	ReadDir(name string) ([]os.FileInfo, error)
+	Glob(pattern string) ([]string, error)
+	Mknod(name string, mode uint32, dev int) error
+	Rename(oldname, newname string) error
+	Chmod(name string, mode os.FileMode) error
+	Chown(name string, uid, gid int) error
+	// Open opens a device node, such as a UIO device, and returns its fd.
+	Open(name string, flags int, perm uint32) (int, error)
+}
+
+// OSFS is the FS of the running system. Its roots let provisioning run
+// against configfs, sysfs and /dev mounted somewhere else, such as a
+// container with the host's sysfs bind-mounted into it.
+type OSFS struct {
+	// Root, if set, is prepended to every path not covered by one of the
+	// more specific roots below.
+	Root string
+	// ConfigfsRoot, if set, is where /sys/kernel/config is mounted.
+	ConfigfsRoot string
+	// SysfsRoot, if set, is where /sys is mounted.
+	SysfsRoot string
+	// DevRoot, if set, is where /dev is mounted.
+	DevRoot string
+}
+
+func (o OSFS) mounts() [][2]string {
+	return [][2]string{
+		{configfsRoot, o.ConfigfsRoot},
+		{sysfsRoot, o.SysfsRoot},
+		{devRoot, o.DevRoot},
+		{"/", o.Root},
+	}
+}
+
+func hasPathPrefix(name, prefix string) bool {
+	return name == prefix || prefix == "/" || strings.HasPrefix(name, prefix+"/")
+}
+
+// resolve maps a kernel path to where it can be found on this system.
+func (o OSFS) resolve(name string) string {
+	for _, m := range o.mounts() {
+		if hasPathPrefix(name, m[0]) {
+			if m[1] == "" {
+				break
+			}
+			return filepath.Join(m[1], strings.TrimPrefix(name, m[0]))
+		}
+	}
+	if o.Root == "" {
+		return name
+	}
+	return filepath.Join(o.Root, name)
+}
+
+// unresolve maps a path on this system back to the kernel's path.
+func (o OSFS) unresolve(name string) string {
+	for _, m := range o.mounts() {
+		if m[1] != "" && hasPathPrefix(name, m[1]) {
+			return filepath.Join(m[0], strings.TrimPrefix(name, m[1]))
+		}
+	}
+	return name
+}
+
+func (o OSFS) ReadFile(name string) ([]byte, error) {
+	return ioutil.ReadFile(o.resolve(name))
+}
+
+func (o OSFS) WriteFile(name string, data []byte, perm os.FileMode) error {
+	return ioutil.WriteFile(o.resolve(name), data, perm)
+}
+
+func (o OSFS) MkdirAll(name string, perm os.FileMode) error {
+	return os.MkdirAll(o.resolve(name), perm)
+}
+
+func (o OSFS) Remove(name string) error {
+	return os.Remove(o.resolve(name))
+}
+
+// Symlink creates newname pointing at oldname. configfs looks targets up in
+// the caller's mount namespace, so one under configfs is resolved; anything
+// else, such as the kernel's node a /dev entry links to, is kept as the
+// kernel's path, for the host to follow.
+func (o OSFS) Symlink(oldname, newname string) error {
+	if hasPathPrefix(oldname, configfsRoot) {
+		oldname = o.resolve(oldname)
+	}
+	return os.Symlink(oldname, o.resolve(newname))
+}
+
+func (o OSFS) Readlink(name string) (string, error) {
+	target, err := os.Readlink(o.resolve(name))
+	if err != nil {
+		return "", err
+	}
+	return o.unresolve(target), nil
+}
+
+func (o OSFS) Stat(name string) (os.FileInfo, error) {
+	return os.Stat(o.resolve(name))
+}
+
+func (o OSFS) Lstat(name string) (os.FileInfo, error) {
+	return os.Lstat(o.resolve(name))
+}
+
+func (o OSFS) ReadDir(name string) ([]os.FileInfo, error) {
+	return ioutil.ReadDir(o.resolve(name))
+}
+
+func (o OSFS) Glob(pattern string) ([]string, error) {
+	matches, err := filepath.Glob(o.resolve(pattern))
+	for i, m := range matches {
+		matches[i] = o.unresolve(m)
+	}
+	return matches, err
+}
+
+func (o OSFS) Mknod(name string, mode uint32, dev int) error {
+	return syscall.Mknod(o.resolve(name), mode, dev)
+}
+
+func (o OSFS) Rename(oldname, newname string) error {
+	return os.Rename(o.resolve(oldname), o.resolve(newname))
+}
+
+func (o OSFS) Chmod(name string, mode os.FileMode) error {
+	return os.Chmod(o.resolve(name), mode)
+}
+
+func (o OSFS) Chown(name string, uid, gid int) error {
+	return os.Chown(o.resolve(name), uid, gid)
+}
+
+func (o OSFS) Open(name string, flags int, perm uint32) (int, error) {
+	return syscall.Open(o.resolve(name), flags, perm)
+}
@@ -0,0 +1,391 @@
+package tcmu
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+)
+
+// fakeSysFS is an OSFS over a fake tree in a temporary directory. Removing a
+// directory removes what's in it, as rmdir does for configfs's own files, but
+// fails while it holds symlinks, which have to be unlinked first. Writes are
+// recorded, since configfs control files take one line per write.
+type fakeSysFS struct {
+	OSFS
+
+	mu     sync.Mutex
+	writes map[string][]string
+}
+
+func newFakeSysFS(t *testing.T) *fakeSysFS {
+	return &fakeSysFS{
+		OSFS:   OSFS{Root: t.TempDir()},
+		writes: make(map[string][]string),
+	}
+}
+
+func (f *fakeSysFS) WriteFile(name string, data []byte, perm os.FileMode) error {
+	f.mu.Lock()
+	f.writes[name] = append(f.writes[name], strings.TrimSuffix(string(data), "\n"))
+	f.mu.Unlock()
+	return f.OSFS.WriteFile(name, data, perm)
+}
+
+func (f *fakeSysFS) Remove(name string) error {
+	if st, err := f.Lstat(name); err == nil && st.IsDir() {
+		err := filepath.Walk(f.resolve(name), func(p string, info os.FileInfo, err error) error {
+			if err == nil && info.Mode()&os.ModeSymlink != 0 {
+				return &os.PathError{Op: "remove", Path: name, Err: syscall.ENOTEMPTY}
+			}
+			return err
+		})
+		if err != nil {
+			return err
+		}
+		return os.RemoveAll(f.resolve(name))
+	}
+	return f.OSFS.Remove(name)
+}
+
+// file creates a file in the fake tree.
+func (f *fakeSysFS) file(t *testing.T, name, content string) {
+	t.Helper()
+	if err := f.MkdirAll(path.Dir(name), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.OSFS.WriteFile(name, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func (f *fakeSysFS) dir(t *testing.T, name string) {
+	t.Helper()
+	if err := f.MkdirAll(name, 0755); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func (f *fakeSysFS) symlink(t *testing.T, target, name string) {
+	t.Helper()
+	f.dir(t, path.Dir(name))
+	if err := f.Symlink(target, name); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func (f *fakeSysFS) exists(name string) bool {
+	_, err := f.Lstat(name)
+	return err == nil
+}
+
+func testDevice(fs FS) *Device {
+	return newDevice("/dev/tcmu", &SCSIHandler{
+		VolumeName: "vol",
+		HBA:        30,
+		LUN:        0,
+		WWN:        GenerateTestWWN(),
+		DataSizes:  DataSizes{VolumeSize: 1 << 30, BlockSize: 512},
+		FS:         fs,
+	})
+}
+
+const testBackstore = "/sys/kernel/config/target/core/user_30/vol"
+
+func TestOSFSRoots(t *testing.T) {
+	o := OSFS{Root: "/r", ConfigfsRoot: "/cfg", DevRoot: "/host/dev"}
+	for _, tt := range []struct{ in, want string }{
+		{"/sys/kernel/config/target/core", "/cfg/target/core"},
+		{"/sys/kernel/config", "/cfg"},
+		{"/sys/class/uio/uio0/name", "/r/sys/class/uio/uio0/name"},
+		{"/dev/uio0", "/host/dev/uio0"},
+		{"/device", "/r/device"},
+	} {
+		if got := o.resolve(tt.in); got != tt.want {
+			t.Errorf("resolve(%s) = %s, want %s", tt.in, got, tt.want)
+		}
+		if got := o.unresolve(tt.want); got != tt.in {
+			t.Errorf("unresolve(%s) = %s, want %s", tt.want, got, tt.in)
+		}
+	}
+	if got := (OSFS{}).resolve("/dev/uio0"); got != "/dev/uio0" {
+		t.Errorf("zero OSFS resolves /dev/uio0 to %s", got)
+	}
+}
+
+func TestOSFSSymlink(t *testing.T) {
+	root := t.TempDir()
+	o := OSFS{ConfigfsRoot: filepath.Join(root, "cfg"), DevRoot: filepath.Join(root, "dev")}
+	lun := "/sys/kernel/config/target/loopback/naa.1/tpgt_1/lun/lun_0"
+	for _, dir := range []string{lun, "/dev/tcmu"} {
+		if err := o.MkdirAll(dir, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, tt := range []struct{ target, link, want string }{
+		{testBackstore, path.Join(lun, "vol"), filepath.Join(root, "cfg/target/core/user_30/vol")},
+		{"/dev/sdb", "/dev/tcmu/vol", "/dev/sdb"},
+	} {
+		if err := o.Symlink(tt.target, tt.link); err != nil {
+			t.Fatal(err)
+		}
+		got, err := os.Readlink(o.resolve(tt.link))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != tt.want {
+			t.Errorf("%s points at %s, want %s", tt.link, got, tt.want)
+		}
+		if got, err := o.Readlink(tt.link); err != nil || got != tt.target {
+			t.Errorf("Readlink(%s) = %s, %v; want %s", tt.link, got, err, tt.target)
+		}
+	}
+	matches, err := o.Glob("/sys/kernel/config/target/loopback/*/tpgt_1/lun/*/vol")
+	if err != nil || len(matches) != 1 || matches[0] != path.Join(lun, "vol") {
+		t.Errorf("Glob found %v, err %v", matches, err)
+	}
+}
+
+func TestPreEnableTcmu(t *testing.T) {
+	fs := newFakeSysFS(t)
+	fs.file(t, testBackstore+"/attrib/max_data_area_mb", "1024")
+	fs.file(t, testBackstore+"/attrib/cmd_time_out", "30")
+	fs.file(t, testBackstore+"/attrib/tmr_notification", "0")
+	d := testDevice(fs)
+	d.scsi.Attributes = DeviceAttributes{
+		MaxDataAreaMB: Int(64),
+		CmdTimeOut:    Int(60),
+	}
+	if err := d.preEnableTcmu(); err != nil {
+		t.Fatal(err)
+	}
+
+	want := map[string][]string{
+		testBackstore + "/control": {
+			"dev_size=1073741824",
+			"dev_config=go-tcmu//vol",
+			"hw_block_size=512",
+			"async=1",
+			"max_data_area_mb=64",
+		},
+		testBackstore + "/attrib/cmd_time_out":     {"60"},
+		testBackstore + "/attrib/tmr_notification": {"1"},
+		testBackstore + "/enable":                  {"1"},
+	}
+	for name, lines := range want {
+		if got := strings.Join(fs.writes[name], "|"); got != strings.Join(lines, "|") {
+			t.Errorf("%s got %q, want %q", name, fs.writes[name], lines)
+		}
+	}
+}
+
+func TestPreEnableTcmuUnsupportedAttribute(t *testing.T) {
+	fs := newFakeSysFS(t)
+	fs.dir(t, testBackstore+"/attrib")
+	d := testDevice(fs)
+	d.scsi.Attributes = DeviceAttributes{EmulateTPU: Bool(true)}
+	err := d.preEnableTcmu()
+	if uerr, ok := err.(*UnsupportedAttributeError); !ok || uerr.Name != "emulate_tpu" {
+		t.Fatalf("got %v, want an UnsupportedAttributeError for emulate_tpu", err)
+	}
+	if len(fs.writes[testBackstore+"/enable"]) != 0 {
+		t.Errorf("backstore enabled despite the error")
+	}
+}
+
+func TestTPGAttribOrder(t *testing.T) {
+	got := tpgAttribOrder(map[string]string{
+		"authentication":          "1",
+		"default_cmdsn_depth":     "64",
+		"demo_mode_write_protect": "0",
+		"cache_dynamic_acls":      "1",
+		"generate_node_acls":      "1",
+		"login_timeout":           "15",
+	})
+	want := []string{"generate_node_acls", "cache_dynamic_acls", "demo_mode_write_protect",
+		"default_cmdsn_depth", "login_timeout", "authentication"}
+	if strings.Join(got, " ") != strings.Join(want, " ") {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+func TestFindDevice(t *testing.T) {
+	fs := newFakeSysFS(t)
+	fs.file(t, "/dev/uio0", "")
+	fs.file(t, "/sys/class/uio/uio0/name", "tcm-user/30/other/go-tcmu//other\n")
+	fs.file(t, "/dev/uio1", "")
+	fs.file(t, "/sys/class/uio/uio1/name", "uio_pci_generic\n")
+	// uio10 is going away, and its sysfs directory already has.
+	fs.file(t, "/dev/uio10", "")
+	fs.file(t, "/dev/uio2", string(make([]byte, 4096)))
+	fs.file(t, "/sys/class/uio/uio2/name", "tcm-user/30/vol/go-tcmu//vol\n")
+	fs.file(t, "/sys/class/uio/uio2/maps/map0/size", "0x1000\n")
+	d := testDevice(fs)
+	if err := d.findDevice(); err != nil {
+		t.Fatal(err)
+	}
+	defer d.unmap()
+	if d.deviceName != "vol" || d.mapsize != 4096 || len(d.mmap) != 4096 {
+		t.Errorf("opened %s, mapsize %d, mapped %d bytes", d.deviceName, d.mapsize, len(d.mmap))
+	}
+}
+
+func TestFindDeviceMissing(t *testing.T) {
+	fs := newFakeSysFS(t)
+	fs.file(t, "/dev/uio0", "")
+	fs.file(t, "/sys/class/uio/uio0/name", "tcm-user/30/other/go-tcmu//other\n")
+	d := testDevice(fs)
+	if err := d.findDevice(); err == nil {
+		d.unmap()
+		t.Fatal("found a device that isn't there")
+	}
+}
+
+func TestShutdownTearsDown(t *testing.T) {
+	fs := newFakeSysFS(t)
+	d := testDevice(fs)
+	tpgt := path.Join(scsiDir, d.scsi.WWN.DeviceID(), "tpgt_1")
+	lun := path.Join(tpgt, "lun", "lun_0")
+	fs.file(t, testBackstore+"/enable", "1")
+	fs.dir(t, testBackstore+"/alua/"+defaultALUAGroup)
+	fs.dir(t, testBackstore+"/alua/left")
+	fs.file(t, tpgt+"/nexus", d.scsi.WWN.NexusID())
+	fs.symlink(t, testBackstore, path.Join(lun, "vol"))
+	fs.symlink(t, "/dev/sdb", "/dev/tcmu/vol")
+
+	if err := d.Shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	for _, p := range []string{
+		path.Join(lun, "vol"), lun, tpgt, path.Dir(tpgt),
+		"/dev/tcmu/vol",
+		testBackstore + "/alua/left", testBackstore,
+	} {
+		if fs.exists(p) {
+			t.Errorf("%s is still there", p)
+		}
+	}
+}
+
+func TestListDevicesAndCleanup(t *testing.T) {
+	fs := newFakeSysFS(t)
+	const (
+		inUse   = "/sys/kernel/config/target/core/user_30/busy"
+		foreign = "/sys/kernel/config/target/core/user_30/file"
+	)
+	fs.file(t, testBackstore+"/enable", "1")
+	fs.file(t, testBackstore+"/attrib/dev_config", "go-tcmu//vol\n")
+	fs.file(t, "/sys/class/uio/uio0/name", "tcm-user/30/vol/go-tcmu//vol\n")
+	fs.file(t, inUse+"/enable", "1")
+	fs.file(t, "/sys/class/uio/uio1/name", "tcm-user/30/busy/go-tcmu//busy\n")
+	fs.symlink(t, "/dev/uio1", "/proc/123/fd/4")
+	fs.file(t, foreign+"/attrib/dev_config", "file//img\n")
+
+	lun := "/sys/kernel/config/target/loopback/naa.5000/tpgt_1/lun/lun_0"
+	fs.file(t, path.Dir(path.Dir(lun))+"/nexus", "naa.5001")
+	fs.symlink(t, testBackstore, path.Join(lun, "vol"))
+	// targetcli names its links after a hash of the backstore.
+	other := "/sys/kernel/config/target/loopback/naa.5000/tpgt_1/lun/lun_1"
+	fs.symlink(t, "../../../../../core/user_30/vol", path.Join(other, "9ab1c2d3e4"))
+	fs.symlink(t, "/dev/sdb", "/dev/tcmu/vol")
+
+	devices, err := ListDevicesFS(fs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(devices) != 2 {
+		t.Fatalf("found %+v, want busy and vol", devices)
+	}
+	busy, vol := devices[0], devices[1]
+	if busy.VolumeName != "busy" || busy.UIO != "uio1" || !busy.InUse || busy.Config != "go-tcmu//busy" {
+		t.Errorf("busy is %+v", busy)
+	}
+	if vol.VolumeName != "vol" || vol.HBA != 30 || vol.UIO != "uio0" || vol.InUse || !vol.Enabled ||
+		len(vol.LUNs) != 2 || vol.LUNs[0] != lun || vol.LUNs[1] != other {
+		t.Errorf("vol is %+v", vol)
+	}
+
+	removed, err := CleanupContext(context.Background(), fs, nil, "/dev/tcmu")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(removed) != 1 || removed[0].VolumeName != "vol" {
+		t.Fatalf("removed %+v, want vol", removed)
+	}
+	for _, p := range []string{testBackstore, lun, other, path.Dir(path.Dir(lun)), "/dev/tcmu/vol"} {
+		if fs.exists(p) {
+			t.Errorf("%s is still there", p)
+		}
+	}
+	for _, p := range []string{inUse, foreign} {
+		if !fs.exists(p) {
+			t.Errorf("%s was removed", p)
+		}
+	}
+}
+
+// ownerFS records Chmod and Chown calls rather than making them.
+type ownerFS struct {
+	*fakeSysFS
+	calls []string
+}
+
+func (f *ownerFS) Chmod(name string, mode os.FileMode) error {
+	f.calls = append(f.calls, fmt.Sprintf("chmod %s %o", name, mode))
+	return nil
+}
+
+func (f *ownerFS) Chown(name string, uid, gid int) error {
+	f.calls = append(f.calls, fmt.Sprintf("chown %s %d:%d", name, uid, gid))
+	return nil
+}
+
+func TestCreateDevEntryOwner(t *testing.T) {
+	for _, tt := range []struct {
+		name string
+		f    LoopbackFabric
+		want []string
+	}{
+		{"symlink", LoopbackFabric{Symlink: true}, nil},
+		{"symlink mode", LoopbackFabric{Symlink: true, Mode: 0640}, []string{"chmod /dev/sdb 640"}},
+		{"symlink root", LoopbackFabric{Symlink: true, UID: Int(0)}, []string{"chown /dev/sdb 0:-1"}},
+		{"symlink group", LoopbackFabric{Symlink: true, GID: Int(6)}, []string{"chown /dev/sdb -1:6"}},
+		{"node", LoopbackFabric{}, []string{"chmod /dev/tcmu/vol.tmp 600"}},
+		{"node owner", LoopbackFabric{Mode: 0660, UID: Int(1000), GID: Int(6)}, []string{
+			"chmod /dev/tcmu/vol.tmp 660",
+			"chown /dev/tcmu/vol.tmp 1000:6",
+		}},
+	} {
+		fs := &ownerFS{fakeSysFS: newFakeSysFS(t)}
+		fs.file(t, "/dev/sdb", "")
+		d := testDevice(fs)
+		d.blockDev = &blockDevice{name: "sdb", major: 8, minor: 16}
+		if !tt.f.Symlink {
+			// Mknod needs privileges the tests don't have.
+			d.fs = &mknodFS{fs}
+		}
+		if err := tt.f.createDevEntry(d); err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		if strings.Join(fs.calls, "|") != strings.Join(tt.want, "|") {
+			t.Errorf("%s: got %q, want %q", tt.name, fs.calls, tt.want)
+		}
+		if !fs.exists("/dev/tcmu/vol") {
+			t.Errorf("%s: no entry", tt.name)
+		}
+	}
+}
+
+// mknodFS makes device nodes as plain files.
+type mknodFS struct {
+	*ownerFS
+}
+
+func (f *mknodFS) Mknod(name string, mode uint32, dev int) error {
+	return f.OSFS.WriteFile(name, nil, os.FileMode(mode).Perm())
+}
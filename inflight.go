@@ -0,0 +1,204 @@
+package tcmu
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/coreos/go-tcmu/scsi"
+	"github.com/prometheus/common/log"
+)
+
+// defaultDrainTimeout bounds the drain phase of Shutdown when the handler
+// doesn't set DrainTimeout.
+const defaultDrainTimeout = 10 * time.Second
+
+// InFlightCommand describes a command that has been read from the ring but
+// not yet completed.
+type InFlightCommand struct {
+	ID      uint16
+	Command byte
+	Started time.Time
+
+	cancel context.CancelFunc
+}
+
+// DrainError is returned by Shutdown when commands are still in flight once
+// the drain phase runs out of time. The device is left running, with its ring
+// still mapped, as the handlers may yet write into it. Calling Shutdown again
+// gives up on them: they are failed with TargetFailure, whatever their
+// handlers send later is dropped, and the teardown carries on.
+type DrainError struct {
+	Unfinished []InFlightCommand
+}
+
+func (e *DrainError) Error() string {
+	b := &bytes.Buffer{}
+	fmt.Fprintf(b, "tcmu: %d commands did not finish draining:", len(e.Unfinished))
+	now := time.Now()
+	for _, c := range e.Unfinished {
+		fmt.Fprintf(b, " [id %d, op 0x%02x, %s]", c.ID, c.Command, now.Sub(c.Started))
+	}
+	return b.String()
+}
+
+// track records cmd as in flight. It returns false if the device is draining
+// and the command should be turned away.
+func (d *Device) track(cmd *SCSICmd) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.inflight == nil {
+		d.inflight = make(map[uint16]InFlightCommand)
+	}
+	d.inflight[cmd.id] = InFlightCommand{
+		ID:      cmd.id,
+		Command: cmd.Command(),
+		Started: time.Now(),
+		cancel:  cmd.cancel,
+	}
+	return d.drained == nil
+}
+
+func (d *Device) untrack(id uint16) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if c, ok := d.inflight[id]; ok && c.cancel != nil {
+		c.cancel()
+	}
+	delete(d.inflight, id)
+	if len(d.inflight) == 0 && d.drained != nil {
+		select {
+		case <-d.drained:
+		default:
+			close(d.drained)
+		}
+	}
+}
+
+// InFlight lists the commands that have been handed to the handlers and not
+// yet completed.
+func (d *Device) InFlight() []InFlightCommand {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	out := make([]InFlightCommand, 0, len(d.inflight))
+	for _, c := range d.inflight {
+		out = append(out, c)
+	}
+	return out
+}
+
+// drain stops the device from accepting new commands, which are answered
+// with BUSY from then on, and waits for the ones in flight to complete. Once
+// a drain has given up, the next one fails what is left instead.
+func (d *Device) drain(ctx context.Context) error {
+	if d.pollDone == nil {
+		return nil
+	}
+	d.mu.Lock()
+	if d.drained == nil {
+		d.drained = make(chan struct{})
+		if len(d.inflight) == 0 {
+			close(d.drained)
+		}
+	}
+	drained := d.drained
+	timedOut := d.timedOut
+	d.mu.Unlock()
+
+	if timedOut {
+		return d.failInFlight(ctx, drained)
+	}
+
+	timeout := d.scsi.DrainTimeout
+	if timeout == 0 {
+		timeout = defaultDrainTimeout
+	}
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case <-drained:
+		return nil
+	case <-timer.C:
+	case <-ctx.Done():
+	}
+	d.mu.Lock()
+	d.timedOut = true
+	d.mu.Unlock()
+	err := &DrainError{Unfinished: d.InFlight()}
+	log.Errorln(err)
+	// Let the stragglers know they're holding things up.
+	ids := make([]uint16, len(err.Unfinished))
+	for i, c := range err.Unfinished {
+		ids[i] = c.ID
+	}
+	d.cancel(ids)
+	return err
+}
+
+// failInFlight fails the commands a drain gave up on with TargetFailure, and
+// waits for those responses to be completed. Whatever their handlers send
+// afterwards is dropped.
+func (d *Device) failInFlight(ctx context.Context, drained chan struct{}) error {
+	d.mu.Lock()
+	d.forced = true
+	d.mu.Unlock()
+	for _, c := range d.InFlight() {
+		log.Errorf("Failing command %d (op 0x%02x) after %s in flight", c.ID, c.Command, time.Since(c.Started))
+		cmd := &SCSICmd{id: c.ID}
+		select {
+		case d.respChan <- cmd.TargetFailure():
+		case <-ctx.Done():
+			return &DrainError{Unfinished: d.InFlight()}
+		}
+	}
+	select {
+	case <-drained:
+		return nil
+	case <-ctx.Done():
+		return &DrainError{Unfinished: d.InFlight()}
+	}
+}
+
+// dropped reports whether a response is for a command that was already
+// failed by failInFlight.
+func (d *Device) dropped(id uint16) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	_, ok := d.inflight[id]
+	return d.forced && !ok
+}
+
+// settled returns a channel that is closed once no commands are in flight.
+// It is used once polling has stopped after failInFlight, when only the BUSY
+// responses to commands turned away since can still be outstanding.
+func (d *Device) settled() chan struct{} {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if len(d.inflight) > 0 {
+		d.drained = make(chan struct{})
+		return d.drained
+	}
+	done := make(chan struct{})
+	close(done)
+	return done
+}
+
+// dispatch hands cmd to the handlers, unless the device is draining or
+// fenced, or its ALUA state doesn't allow the command.
+func (d *Device) dispatch(cmd *SCSICmd) {
+	if !d.track(cmd) {
+		d.respChan <- cmd.RespondStatus(scsi.SamStatBusy)
+		return
+	}
+	if d.Fenced() != nil {
+		d.respChan <- cmd.TargetFailure()
+		return
+	}
+	if resp, ok := d.checkALUA(cmd); !ok {
+		d.respChan <- resp
+		return
+	}
+	d.workers.grow()
+	d.cmdChan <- cmd
+}
@@ -0,0 +1,101 @@
+package tcmu
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/coreos/go-tcmu/scsi"
+)
+
+// drainingDevice is a device that looks to be polling, with the given
+// commands in flight.
+func drainingDevice(t *testing.T, ids ...uint16) *Device {
+	d := testDevice(OSFS{})
+	d.scsi.DrainTimeout = 10 * time.Millisecond
+	d.pollDone = make(chan struct{})
+	d.respChan = make(chan SCSIResponse, 8)
+	for _, id := range ids {
+		if !d.track(&SCSICmd{id: id, cdb: []byte{scsi.Write10}}) {
+			t.Fatalf("command %d turned away", id)
+		}
+	}
+	return d
+}
+
+// complete stands in for the response loop, completing what is sent on
+// respChan unless it is dropped.
+func complete(d *Device) <-chan SCSIResponse {
+	completed := make(chan SCSIResponse, 8)
+	go func() {
+		for resp := range d.respChan {
+			if d.dropped(resp.id) {
+				continue
+			}
+			d.untrack(resp.id)
+			completed <- resp
+		}
+		close(completed)
+	}()
+	return completed
+}
+
+func TestDrainTimesOutThenForces(t *testing.T) {
+	d := drainingDevice(t, 1, 2)
+	completed := complete(d)
+
+	err := d.drain(context.Background())
+	derr, ok := err.(*DrainError)
+	if !ok || len(derr.Unfinished) != 2 {
+		t.Fatalf("first drain returned %v, want a DrainError for 2 commands", err)
+	}
+	if d.track(&SCSICmd{id: 3, cdb: []byte{scsi.Read10}}) {
+		t.Errorf("new command accepted while draining")
+	}
+	d.untrack(3)
+
+	start := time.Now()
+	if err := d.drain(context.Background()); err != nil {
+		t.Fatalf("second drain: %v", err)
+	}
+	if time.Since(start) >= d.scsi.DrainTimeout*10 {
+		t.Errorf("second drain waited %s", time.Since(start))
+	}
+	failed := map[uint16]bool{}
+	for i := 0; i < 2; i++ {
+		resp := <-completed
+		if resp.Status() != scsi.SamStatCheckCondition || resp.senseBuffer[2] != scsi.SenseHardwareError {
+			t.Errorf("command %d completed with status 0x%02x", resp.id, resp.Status())
+		}
+		failed[resp.id] = true
+	}
+	if !failed[1] || !failed[2] {
+		t.Errorf("failed %v, want 1 and 2", failed)
+	}
+
+	// The handler's own response, when it finally comes, goes nowhere.
+	d.respChan <- SCSIResponse{id: 1, status: scsi.SamStatGood}
+	close(d.respChan)
+	if resp, ok := <-completed; ok {
+		t.Errorf("late response for %d completed", resp.id)
+	}
+}
+
+func TestDrainContextDone(t *testing.T) {
+	d := drainingDevice(t, 1)
+	d.scsi.DrainTimeout = time.Hour
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, ok := d.drain(ctx).(*DrainError); !ok {
+		t.Fatalf("want a DrainError once ctx is done")
+	}
+	// Having given up once, the next drain fails the command at once.
+	completed := complete(d)
+	if err := d.drain(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if resp := <-completed; resp.id != 1 || resp.Status() != scsi.SamStatCheckCondition {
+		t.Errorf("completed %d with status 0x%02x", resp.id, resp.Status())
+	}
+	close(d.respChan)
+}
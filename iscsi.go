@@ -0,0 +1,302 @@
+package tcmu
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path"
+	"sort"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	iscsiDir = "/sys/kernel/config/target/iscsi"
+
+	defaultISCSIPortal = "0.0.0.0:3260"
+)
+
+// ISCSIFabric exports the device over iSCSI, as a LUN of a target portal
+// group. Several devices may share one target and TPG, each with its own LUN
+// (the handler's LUN); the TPG is set up by the first of them to be exported
+// and removed with the last.
+type ISCSIFabric struct {
+	// IQN is the target's name, eg "iqn.2003-01.org.example:storage".
+	IQN string
+	// TPG is the target portal group tag. Zero means 1.
+	TPG int
+	// Portals are the addresses the TPG listens on, as "ip:port", or
+	// "[ip]:port" for IPv6. Nil means 0.0.0.0:3260.
+	Portals []string
+	// ACLs are the initiators allowed to see the LUN. If there are none, the
+	// TPG runs in demo mode, and any initiator may log in.
+	ACLs []ISCSIACL
+	// CHAP, if set, requires initiators to authenticate with CHAP. In demo
+	// mode these credentials apply to every initiator; otherwise they are
+	// used for ACLs without credentials of their own.
+	CHAP *CHAPCredentials
+	// Attributes are further TPG attributes to set, by their name under
+	// attrib/, eg "default_cmdsn_depth".
+	Attributes map[string]string
+}
+
+// ISCSIACL gives an initiator access to the LUN.
+type ISCSIACL struct {
+	// InitiatorIQN is the initiator's name.
+	InitiatorIQN string
+	// CHAP, if set, are the credentials this initiator logs in with.
+	CHAP *CHAPCredentials
+}
+
+// CHAPCredentials are the CHAP secrets for an iSCSI login. The mutual
+// credentials, if set, are the ones the target authenticates itself with.
+type CHAPCredentials struct {
+	UserID         string
+	Password       string
+	MutualUserID   string
+	MutualPassword string
+}
+
+func (f ISCSIFabric) tpgPath() string {
+	tpg := f.TPG
+	if tpg == 0 {
+		tpg = 1
+	}
+	return path.Join(iscsiDir, f.IQN, fmt.Sprintf("tpgt_%d", tpg))
+}
+
+func (f ISCSIFabric) authenticated() bool {
+	if f.CHAP != nil {
+		return true
+	}
+	for _, acl := range f.ACLs {
+		if acl.CHAP != nil {
+			return true
+		}
+	}
+	return false
+}
+
+// LUNPath is the configfs directory of the device's LUN in the TPG.
+func (f ISCSIFabric) LUNPath(d *Device) string {
+	return path.Join(f.tpgPath(), "lun", fmt.Sprintf("lun_%d", d.scsi.LUN))
+}
+
+// Nexus names the target and TPG. The initiator is only known if the TPG has
+// a single ACL and isn't in demo mode, as then nobody else can log in.
+func (f ISCSIFabric) Nexus(d *Device) Nexus {
+	n := Nexus{
+		Fabric: "iscsi",
+		Target: f.IQN,
+		TPG:    f.TPG,
+	}
+	if n.TPG == 0 {
+		n.TPG = 1
+	}
+	if len(f.ACLs) == 1 && f.Attributes["generate_node_acls"] != "1" {
+		n.Initiator = f.ACLs[0].InitiatorIQN
+	}
+	return n
+}
+
+func (f ISCSIFabric) Export(ctx context.Context, d *Device) error {
+	if f.IQN == "" {
+		return fmt.Errorf("iSCSI fabric needs a target IQN")
+	}
+	tpg := f.tpgPath()
+	lunName := fmt.Sprintf("lun_%d", d.scsi.LUN)
+	lunPath := path.Join(tpg, "lun", lunName)
+
+	logrus.Debugf("Creating directory: %s", lunPath)
+	if err := d.fs.MkdirAll(lunPath, 0755); err != nil && !os.IsExist(err) {
+		return err
+	}
+	if err := symlinkOnce(d.fs, d.BackstorePath(), path.Join(lunPath, d.scsi.VolumeName)); err != nil {
+		return err
+	}
+
+	portals := f.Portals
+	if portals == nil {
+		portals = []string{defaultISCSIPortal}
+	}
+	for _, p := range portals {
+		if err := d.fs.MkdirAll(path.Join(tpg, "np", p), 0755); err != nil && !os.IsExist(err) {
+			return err
+		}
+	}
+
+	for _, acl := range f.ACLs {
+		aclPath := path.Join(tpg, "acls", acl.InitiatorIQN)
+		mapped := path.Join(aclPath, lunName)
+		if err := d.fs.MkdirAll(mapped, 0755); err != nil && !os.IsExist(err) {
+			return err
+		}
+		if err := symlinkOnce(d.fs, lunPath, path.Join(mapped, d.scsi.VolumeName)); err != nil {
+			return err
+		}
+		chap := acl.CHAP
+		if chap == nil {
+			chap = f.CHAP
+		}
+		if err := writeCHAP(d.fs, path.Join(aclPath, "auth"), chap); err != nil {
+			return err
+		}
+	}
+
+	attrs := map[string]string{
+		"authentication": "0",
+	}
+	if f.authenticated() {
+		attrs["authentication"] = "1"
+	}
+	if len(f.ACLs) == 0 {
+		attrs["generate_node_acls"] = "1"
+		attrs["cache_dynamic_acls"] = "1"
+		attrs["demo_mode_write_protect"] = "0"
+		if err := writeCHAP(d.fs, path.Join(tpg, "auth"), f.CHAP); err != nil {
+			return err
+		}
+	}
+	for k, v := range f.Attributes {
+		attrs[k] = v
+	}
+	for _, k := range tpgAttribOrder(attrs) {
+		if err := writeLines(d.fs, path.Join(tpg, "attrib", k), []string{attrs[k]}); err != nil {
+			return err
+		}
+	}
+
+	return writeLines(d.fs, path.Join(tpg, "enable"), []string{"1"})
+}
+
+// tpgAttribOrder returns the order to write a TPG's attributes in: the ACL
+// mode first, then the rest by name, and authentication last, once the mode
+// and credentials it applies to are in place.
+func tpgAttribOrder(attrs map[string]string) []string {
+	first := []string{"generate_node_acls", "cache_dynamic_acls", "demo_mode_write_protect"}
+	const last = "authentication"
+	placed := map[string]bool{last: true}
+	var keys, rest []string
+	for _, k := range first {
+		placed[k] = true
+		if _, ok := attrs[k]; ok {
+			keys = append(keys, k)
+		}
+	}
+	for k := range attrs {
+		if !placed[k] {
+			rest = append(rest, k)
+		}
+	}
+	sort.Strings(rest)
+	keys = append(keys, rest...)
+	if _, ok := attrs[last]; ok {
+		keys = append(keys, last)
+	}
+	return keys
+}
+
+func (f ISCSIFabric) Unexport(ctx context.Context, d *Device) error {
+	if f.IQN == "" {
+		return nil
+	}
+	tpg := f.tpgPath()
+	lunName := fmt.Sprintf("lun_%d", d.scsi.LUN)
+	lunPath := path.Join(tpg, "lun", lunName)
+
+	/*
+		We're removing, for each ACL:
+		/sys/kernel/config/target/iscsi/<iqn>/tpgt_N/acls/<initiator>/lun_L/<volume name>
+		/sys/kernel/config/target/iscsi/<iqn>/tpgt_N/acls/<initiator>/lun_L
+		then:
+		/sys/kernel/config/target/iscsi/<iqn>/tpgt_N/lun/lun_L/<volume name>
+		/sys/kernel/config/target/iscsi/<iqn>/tpgt_N/lun/lun_L
+		and, if that was the TPG's last LUN, the TPG and maybe the target.
+	*/
+	acls, _ := d.fs.ReadDir(path.Join(tpg, "acls"))
+	for _, acl := range acls {
+		mapped := path.Join(tpg, "acls", acl.Name(), lunName)
+		for _, p := range []string{path.Join(mapped, d.scsi.VolumeName), mapped} {
+			if err := remove(ctx, d.fs, p); err != nil {
+				return err
+			}
+		}
+	}
+	for _, p := range []string{path.Join(lunPath, d.scsi.VolumeName), lunPath} {
+		if err := remove(ctx, d.fs, p); err != nil {
+			return err
+		}
+	}
+
+	if luns, err := d.fs.ReadDir(path.Join(tpg, "lun")); err != nil || len(luns) > 0 {
+		return nil
+	}
+	return removeTPG(ctx, d.fs, tpg)
+}
+
+// removeTPG removes an iSCSI TPG that has no LUNs left, along with its ACLs
+// and portals, and then its target if it has no other TPGs.
+func removeTPG(ctx context.Context, fs FS, tpg string) error {
+	if _, err := fs.Stat(tpg); os.IsNotExist(err) {
+		return nil
+	}
+	if err := writeLines(fs, path.Join(tpg, "enable"), []string{"0"}); err != nil {
+		return err
+	}
+	var pathsToRemove []string
+	acls, _ := fs.ReadDir(path.Join(tpg, "acls"))
+	for _, acl := range acls {
+		pathsToRemove = append(pathsToRemove, path.Join(tpg, "acls", acl.Name()))
+	}
+	nps, _ := fs.ReadDir(path.Join(tpg, "np"))
+	for _, np := range nps {
+		pathsToRemove = append(pathsToRemove, path.Join(tpg, "np", np.Name()))
+	}
+	pathsToRemove = append(pathsToRemove, tpg)
+	for _, p := range pathsToRemove {
+		if err := remove(ctx, fs, p); err != nil {
+			return err
+		}
+	}
+
+	target := path.Dir(tpg)
+	entries, err := fs.ReadDir(target)
+	if err != nil {
+		return nil
+	}
+	for _, e := range entries {
+		if e.IsDir() && strings.HasPrefix(e.Name(), "tpgt_") {
+			return nil
+		}
+	}
+	return remove(ctx, fs, target)
+}
+
+// writeCHAP sets the CHAP credentials in an auth/ directory, or clears them
+// if chap is nil.
+func writeCHAP(fs FS, authDir string, chap *CHAPCredentials) error {
+	if chap == nil {
+		chap = &CHAPCredentials{}
+	}
+	for name, v := range map[string]string{
+		"userid":          chap.UserID,
+		"password":        chap.Password,
+		"userid_mutual":   chap.MutualUserID,
+		"password_mutual": chap.MutualPassword,
+	} {
+		if err := writeLines(fs, path.Join(authDir, name), []string{v}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// symlinkOnce links newname to oldname, unless newname already exists.
+func symlinkOnce(fs FS, oldname, newname string) error {
+	if _, err := fs.Lstat(newname); err == nil {
+		return nil
+	}
+	logrus.Debugf("Linking: %s => %s", newname, oldname)
+	return fs.Symlink(oldname, newname)
+}
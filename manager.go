@@ -0,0 +1,346 @@
+package tcmu
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/signal"
+	"sort"
+	"sync"
+	"syscall"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	defaultFirstHBA      = 30
+	defaultDevicesPerHBA = 128
+)
+
+// DeviceState is where a Manager's device is in its life.
+type DeviceState int
+
+const (
+	DeviceOpening DeviceState = iota
+	DeviceOpen
+	DeviceClosing
+	DeviceClosed
+	// DeviceFailed devices failed to open, and have been torn down again.
+	DeviceFailed
+)
+
+func (s DeviceState) String() string {
+	switch s {
+	case DeviceOpening:
+		return "opening"
+	case DeviceOpen:
+		return "open"
+	case DeviceClosing:
+		return "closing"
+	case DeviceClosed:
+		return "closed"
+	case DeviceFailed:
+		return "failed"
+	}
+	return fmt.Sprintf("DeviceState(%d)", int(s))
+}
+
+// ManagedDevice describes one of a Manager's devices.
+type ManagedDevice struct {
+	VolumeName string
+	HBA        int
+	LUN        int
+	State      DeviceState
+	// Err is why the device failed to open, or to close.
+	Err error
+	// Device is the device itself, once it is open.
+	Device *Device
+
+	// opened is closed once the device has opened, or failed to.
+	opened chan struct{}
+}
+
+// Manager serves many devices from one process. It gives each device its HBA
+// and LUN, keeps volume names unique, and tracks the devices' states. The
+// devices share one uevent socket to find their disks. Its methods are safe
+// to call concurrently, and devices open and close in parallel.
+type Manager struct {
+	// DevPath is where the devices' nodes are created.
+	DevPath string
+	// FirstHBA is the lowest HBA number to use. Zero means 30.
+	FirstHBA int
+	// DevicesPerHBA is how many backstores go in each HBA before the next
+	// one is used. Zero means 128.
+	DevicesPerHBA int
+	// FS, if set, is given to handlers that don't have their own.
+	FS FS
+	// CleanupOrphans, if set, runs Cleanup before the first device is
+	// opened, so that nothing a crashed process left behind clashes with
+	// the new devices.
+	CleanupOrphans bool
+
+	mu       sync.Mutex
+	devices  map[string]*ManagedDevice
+	hbaCount map[int]int
+	luns     map[int]bool
+	// shutting is set while Shutdown runs, to turn away new devices.
+	shutting bool
+	// uevents is shared by the devices, which all wait for their disks to
+	// appear.
+	uevents ueventHub
+
+	// cleanupMu serializes the orphan cleanup without holding up the rest
+	// of the manager while it walks the system.
+	cleanupMu sync.Mutex
+	cleaned   bool
+}
+
+// NewManager returns a Manager that creates device nodes under devPath.
+func NewManager(devPath string) *Manager {
+	return &Manager{DevPath: devPath}
+}
+
+func (m *Manager) init() {
+	if m.devices == nil {
+		m.devices = make(map[string]*ManagedDevice)
+		m.hbaCount = make(map[int]int)
+		m.luns = make(map[int]bool)
+	}
+}
+
+// allocate picks the HBA and LUN for a new device: the first HBA with room,
+// and the lowest LUN not in use, so that devices sharing a fabric target
+// never clash.
+func (m *Manager) allocate() (hba, lun int) {
+	hba = m.FirstHBA
+	if hba == 0 {
+		hba = defaultFirstHBA
+	}
+	per := m.DevicesPerHBA
+	if per == 0 {
+		per = defaultDevicesPerHBA
+	}
+	for m.hbaCount[hba] >= per {
+		hba++
+	}
+	for m.luns[lun] {
+		lun++
+	}
+	m.hbaCount[hba]++
+	m.luns[lun] = true
+	return hba, lun
+}
+
+func (m *Manager) release(md *ManagedDevice) {
+	m.hbaCount[md.HBA]--
+	if m.hbaCount[md.HBA] == 0 {
+		delete(m.hbaCount, md.HBA)
+	}
+	delete(m.luns, md.LUN)
+}
+
+// Open opens a device for h. The manager assigns its HBA and LUN, overriding
+// the handler's, and gives it a WWN from its volume name if it has none. It
+// fails if a device with the same volume name is already open.
+func (m *Manager) Open(ctx context.Context, h *SCSIHandler) (*Device, error) {
+	if err := m.cleanupOnce(ctx); err != nil {
+		return nil, err
+	}
+
+	m.mu.Lock()
+	m.init()
+	if m.shutting {
+		m.mu.Unlock()
+		return nil, fmt.Errorf("tcmu: not opening %s, shutting down", h.VolumeName)
+	}
+	if md, ok := m.devices[h.VolumeName]; ok && md.State != DeviceClosed && md.State != DeviceFailed {
+		m.mu.Unlock()
+		return nil, fmt.Errorf("tcmu: volume %s is already %s", h.VolumeName, md.State)
+	}
+	md := &ManagedDevice{VolumeName: h.VolumeName, State: DeviceOpening, opened: make(chan struct{})}
+	md.HBA, md.LUN = m.allocate()
+	m.devices[h.VolumeName] = md
+	m.mu.Unlock()
+
+	h.HBA, h.LUN = md.HBA, md.LUN
+	if h.WWN == nil {
+		h.WWN = NaaWWN{
+			OUI:      "000000",
+			VendorID: GenerateSerial(h.VolumeName),
+		}
+	}
+	if h.FS == nil {
+		h.FS = m.FS
+	}
+	h.uevents = &m.uevents
+	d, err := OpenTCMUDeviceContext(ctx, m.DevPath, h)
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	defer close(md.opened)
+	if err != nil {
+		md.State = DeviceFailed
+		md.Err = err
+		m.release(md)
+		return nil, err
+	}
+	md.State = DeviceOpen
+	md.Device = d
+	return d, nil
+}
+
+func (m *Manager) cleanupOnce(ctx context.Context) error {
+	m.cleanupMu.Lock()
+	defer m.cleanupMu.Unlock()
+	if !m.CleanupOrphans || m.cleaned {
+		return nil
+	}
+	fs := m.FS
+	if fs == nil {
+		fs = OSFS{}
+	}
+	removed, err := CleanupContext(ctx, fs, nil, m.DevPath)
+	for _, info := range removed {
+		logrus.Infof("Cleaned up orphaned device %s", info.Path)
+	}
+	if err != nil {
+		return err
+	}
+	m.cleaned = true
+	return nil
+}
+
+// Close shuts down the device for the named volume, and frees its HBA and
+// LUN. If that fails, the device stays in the closing state, and Close can be
+// called again.
+func (m *Manager) Close(ctx context.Context, volumeName string) error {
+	m.mu.Lock()
+	md, ok := m.devices[volumeName]
+	if !ok || (md.State != DeviceOpen && md.State != DeviceClosing) {
+		m.mu.Unlock()
+		return fmt.Errorf("tcmu: volume %s is not open", volumeName)
+	}
+	if md.State == DeviceClosing && md.Err == nil {
+		// Someone else is closing it.
+		m.mu.Unlock()
+		return fmt.Errorf("tcmu: volume %s is already closing", volumeName)
+	}
+	md.State = DeviceClosing
+	md.Err = nil
+	d := md.Device
+	m.mu.Unlock()
+
+	err := d.Shutdown(ctx)
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	md.Err = err
+	if err != nil {
+		return err
+	}
+	md.State = DeviceClosed
+	md.Device = nil
+	m.release(md)
+	return nil
+}
+
+// Device returns the open device for the named volume.
+func (m *Manager) Device(volumeName string) (*Device, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	md, ok := m.devices[volumeName]
+	if !ok || md.State != DeviceOpen {
+		return nil, false
+	}
+	return md.Device, true
+}
+
+// Devices lists the manager's devices, in order of volume name.
+func (m *Manager) Devices() []ManagedDevice {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	out := make([]ManagedDevice, 0, len(m.devices))
+	for _, md := range m.devices {
+		out = append(out, *md)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].VolumeName < out[j].VolumeName })
+	return out
+}
+
+// Shutdown closes every open device, in parallel. Devices still opening are
+// waited for first, and no new ones are opened until it returns. A device
+// whose commands don't drain in time is closed again, failing them. It
+// returns the first error, having tried them all.
+func (m *Manager) Shutdown(ctx context.Context) error {
+	m.mu.Lock()
+	m.shutting = true
+	var opening []chan struct{}
+	for _, md := range m.devices {
+		if md.State == DeviceOpening {
+			opening = append(opening, md.opened)
+		}
+	}
+	m.mu.Unlock()
+	defer func() {
+		m.mu.Lock()
+		m.shutting = false
+		m.mu.Unlock()
+	}()
+
+	var first error
+	for _, opened := range opening {
+		select {
+		case <-opened:
+		case <-ctx.Done():
+			if first == nil {
+				first = fmt.Errorf("tcmu: waiting for devices to open: %v", ctx.Err())
+			}
+		}
+	}
+
+	var names []string
+	for _, md := range m.Devices() {
+		if md.State == DeviceOpen || md.State == DeviceClosing {
+			names = append(names, md.VolumeName)
+		}
+	}
+	errs := make(chan error, len(names))
+	for _, name := range names {
+		go func(name string) {
+			err := m.Close(ctx, name)
+			if _, ok := err.(*DrainError); ok {
+				logrus.Errorf("Failing what is left of %s: %v", name, err)
+				err = m.Close(ctx, name)
+			}
+			if err != nil {
+				logrus.Errorf("Failed to close %s: %v", name, err)
+			}
+			errs <- err
+		}(name)
+	}
+	for range names {
+		if err := <-errs; err != nil && first == nil {
+			first = err
+		}
+	}
+	return first
+}
+
+// ShutdownOnSignal shuts every device down once the process gets one of sigs,
+// or SIGINT or SIGTERM if none are given. The returned channel delivers
+// Shutdown's result.
+func (m *Manager) ShutdownOnSignal(sigs ...os.Signal) <-chan error {
+	if len(sigs) == 0 {
+		sigs = []os.Signal{syscall.SIGINT, syscall.SIGTERM}
+	}
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, sigs...)
+	done := make(chan error, 1)
+	go func() {
+		sig := <-c
+		signal.Stop(c)
+		logrus.Infof("Got %v, shutting down", sig)
+		done <- m.Shutdown(context.Background())
+	}()
+	return done
+}
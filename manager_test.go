@@ -0,0 +1,97 @@
+package tcmu
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestManagerShutdownWaitsForOpens(t *testing.T) {
+	m := NewManager("/dev/tcmu")
+	m.init()
+	md := &ManagedDevice{VolumeName: "vol", State: DeviceOpening, opened: make(chan struct{})}
+	m.devices["vol"] = md
+
+	done := make(chan error, 1)
+	go func() { done <- m.Shutdown(context.Background()) }()
+	select {
+	case err := <-done:
+		t.Fatalf("Shutdown returned %v while vol was opening", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+	if _, err := m.Open(context.Background(), &SCSIHandler{VolumeName: "other"}); err == nil {
+		t.Errorf("opened a device while shutting down")
+	}
+
+	m.mu.Lock()
+	md.State = DeviceFailed
+	close(md.opened)
+	m.mu.Unlock()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("Shutdown: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Shutdown still waiting")
+	}
+	if m.shutting {
+		t.Errorf("still turning devices away after Shutdown")
+	}
+}
+
+func TestManagerShutdownGivesUpOnOpens(t *testing.T) {
+	m := NewManager("/dev/tcmu")
+	m.init()
+	m.devices["vol"] = &ManagedDevice{VolumeName: "vol", State: DeviceOpening, opened: make(chan struct{})}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if err := m.Shutdown(ctx); err == nil {
+		t.Errorf("Shutdown didn't report the device left opening")
+	}
+}
+
+// blockingFS holds up Glob until it is released.
+type blockingFS struct {
+	*fakeSysFS
+	entered, release chan struct{}
+}
+
+func (f *blockingFS) Glob(pattern string) ([]string, error) {
+	select {
+	case f.entered <- struct{}{}:
+	default:
+	}
+	<-f.release
+	return f.fakeSysFS.Glob(pattern)
+}
+
+func TestManagerCleanupDoesNotBlock(t *testing.T) {
+	fs := &blockingFS{
+		fakeSysFS: newFakeSysFS(t),
+		entered:   make(chan struct{}, 1),
+		release:   make(chan struct{}),
+	}
+	m := NewManager("/dev/tcmu")
+	m.FS = fs
+	m.CleanupOrphans = true
+	done := make(chan error, 1)
+	go func() { done <- m.cleanupOnce(context.Background()) }()
+	<-fs.entered
+
+	listed := make(chan []ManagedDevice, 1)
+	go func() { listed <- m.Devices() }()
+	select {
+	case <-listed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Devices blocked behind the cleanup")
+	}
+
+	close(fs.release)
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	if !m.cleaned {
+		t.Errorf("cleanup not recorded")
+	}
+}
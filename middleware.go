@@ -0,0 +1,161 @@
+package tcmu
+
+import (
+	"runtime/debug"
+	"time"
+
+	"github.com/coreos/go-tcmu/scsi"
+	"github.com/sirupsen/logrus"
+)
+
+// Middleware wraps a SCSICmdHandler with behaviour of its own, such as
+// logging, typically calling through to it for the actual work.
+type Middleware func(SCSICmdHandler) SCSICmdHandler
+
+// Chain wraps h in the middlewares, the first being outermost, so that
+// Chain(h, Recovery, Logging) recovers from panics in Logging as well as h.
+// The result can be used with SingleThreadedDevReady, MultiThreadedDevReady
+// or anything else taking a SCSICmdHandler.
+func Chain(h SCSICmdHandler, mws ...Middleware) SCSICmdHandler {
+	for i := len(mws) - 1; i >= 0; i-- {
+		h = mws[i](h)
+	}
+	return h
+}
+
+// Logging logs every command and its status at debug level.
+func Logging(next SCSICmdHandler) SCSICmdHandler {
+	return SCSICmdHandlerFunc(func(cmd *SCSICmd) (SCSIResponse, error) {
+		start := time.Now()
+		resp, err := next.HandleCommand(cmd)
+		logrus.Debugf("SCSI command 0x%02x (id %d): status 0x%02x in %v, err %v",
+			cmd.Command(), cmd.id, resp.status, time.Since(start), err)
+		return resp, err
+	})
+}
+
+// Recovery turns a panic in the handler into a hardware error for the
+// command, instead of a crash of the whole process.
+func Recovery(next SCSICmdHandler) SCSICmdHandler {
+	return SCSICmdHandlerFunc(func(cmd *SCSICmd) (resp SCSIResponse, err error) {
+		defer func() {
+			if r := recover(); r != nil {
+				logrus.Errorf("Panic handling SCSI command 0x%02x: %v\n%s", cmd.Command(), r, debug.Stack())
+				resp, err = cmd.TargetFailure(), nil
+			}
+		}()
+		return next.HandleCommand(cmd)
+	})
+}
+
+// Timing calls observe with how long each command took to handle, for
+// latency metrics.
+func Timing(observe func(cmd *SCSICmd, resp SCSIResponse, elapsed time.Duration)) Middleware {
+	return func(next SCSICmdHandler) SCSICmdHandler {
+		return SCSICmdHandlerFunc(func(cmd *SCSICmd) (SCSIResponse, error) {
+			start := time.Now()
+			resp, err := next.HandleCommand(cmd)
+			observe(cmd, resp, time.Since(start))
+			return resp, err
+		})
+	}
+}
+
+// AllowOpcodes passes only the given opcodes on to the handler; the others
+// get NotHandled.
+func AllowOpcodes(ops ...byte) Middleware {
+	return opcodeFilter(ops, true)
+}
+
+// DenyOpcodes answers the given opcodes with NotHandled, and passes the
+// others on to the handler.
+func DenyOpcodes(ops ...byte) Middleware {
+	return opcodeFilter(ops, false)
+}
+
+func opcodeFilter(ops []byte, allow bool) Middleware {
+	var set [256]bool
+	for _, op := range ops {
+		set[op] = true
+	}
+	return func(next SCSICmdHandler) SCSICmdHandler {
+		return SCSICmdHandlerFunc(func(cmd *SCSICmd) (SCSIResponse, error) {
+			if set[cmd.Command()] != allow {
+				return cmd.NotHandled(), nil
+			}
+			return next.HandleCommand(cmd)
+		})
+	}
+}
+
+// isMediaAccess reports whether op addresses the medium with an LBA and a
+// number of blocks, in the usual places for its CDB length.
+func isMediaAccess(op byte) bool {
+	switch op {
+	case scsi.Read6, scsi.Read10, scsi.Read12, scsi.Read16,
+		scsi.Write6, scsi.Write10, scsi.Write12, scsi.Write16,
+		scsi.WriteVerify, scsi.WriteVerify12, scsi.WriteVerify16,
+		scsi.Verify, scsi.Verify12, scsi.Verify16,
+		scsi.WriteSame, scsi.WriteSame16,
+		scsi.SynchronizeCache, scsi.SynchronizeCache16,
+		scsi.PreFetch:
+		return true
+	}
+	return false
+}
+
+// isWrite reports whether op changes the medium.
+func isWrite(op byte) bool {
+	switch op {
+	case scsi.Write6, scsi.Write10, scsi.Write12, scsi.Write16,
+		scsi.WriteVerify, scsi.WriteVerify12, scsi.WriteVerify16,
+		scsi.WriteSame, scsi.WriteSame16, scsi.WriteLong, scsi.WriteLong2,
+		scsi.CompareAndWrite, scsi.Unmap, scsi.FormatUnit, scsi.Xdwriteread10:
+		return true
+	}
+	return false
+}
+
+// CheckLBARange checks that a media access command stays within the device:
+// its LBA must be one of the device's blocks, and its blocks must not run past
+// the end. If it doesn't, it returns false and the LOGICAL BLOCK ADDRESS OUT
+// OF RANGE response to fail it with. Other commands always pass, unless the
+// device has no block size, which fails every media access.
+func CheckLBARange(cmd *SCSICmd) (SCSIResponse, bool) {
+	if !isMediaAccess(cmd.Command()) {
+		return SCSIResponse{}, true
+	}
+	sizes := cmd.Device().Sizes()
+	if sizes.BlockSize <= 0 {
+		logrus.Errorf("SCSI command 0x%02x on a device with block size %d", cmd.Command(), sizes.BlockSize)
+		return cmd.TargetFailure(), false
+	}
+	blocks := uint64(sizes.VolumeSize / sizes.BlockSize)
+	lba, n := cmd.LBA(), uint64(cmd.XferLen())
+	if lba >= blocks || n > blocks-lba {
+		return cmd.CheckCondition(scsi.SenseIllegalRequest, scsi.AscLbaOutOfRange), false
+	}
+	return SCSIResponse{}, true
+}
+
+// LBARangeCheck fails media access commands that run past the end of the
+// device, as CheckLBARange does, before they reach the handler.
+func LBARangeCheck(next SCSICmdHandler) SCSICmdHandler {
+	return SCSICmdHandlerFunc(func(cmd *SCSICmd) (SCSIResponse, error) {
+		if resp, ok := CheckLBARange(cmd); !ok {
+			return resp, nil
+		}
+		return next.HandleCommand(cmd)
+	})
+}
+
+// ReadOnly fails every command that would change the medium with DATA
+// PROTECT, WRITE PROTECTED.
+func ReadOnly(next SCSICmdHandler) SCSICmdHandler {
+	return SCSICmdHandlerFunc(func(cmd *SCSICmd) (SCSIResponse, error) {
+		if isWrite(cmd.Command()) {
+			return cmd.CheckCondition(scsi.SenseDataProtect, scsi.AscWriteProtected), nil
+		}
+		return next.HandleCommand(cmd)
+	})
+}
@@ -0,0 +1,59 @@
+package tcmu
+
+import (
+	"encoding/binary"
+	"testing"
+
+	"github.com/coreos/go-tcmu/scsi"
+)
+
+// read16 returns a READ(16) of n blocks at lba on d.
+func read16(d *Device, lba uint64, n uint32) *SCSICmd {
+	cdb := make([]byte, 16)
+	cdb[0] = scsi.Read16
+	binary.BigEndian.PutUint64(cdb[2:10], lba)
+	binary.BigEndian.PutUint32(cdb[10:14], n)
+	return &SCSICmd{cdb: cdb, device: d}
+}
+
+func TestCheckLBARange(t *testing.T) {
+	d := testDevice(OSFS{})
+	d.scsi.DataSizes = DataSizes{VolumeSize: 100 * 512, BlockSize: 512}
+	for _, tt := range []struct {
+		lba uint64
+		n   uint32
+		ok  bool
+	}{
+		{0, 100, true},
+		{99, 1, true},
+		{99, 0, true},
+		{0, 0, true},
+		{99, 2, false},
+		{100, 0, false},
+		{100, 1, false},
+		{1 << 63, 1, false},
+		{1, 1<<32 - 1, false},
+	} {
+		resp, ok := CheckLBARange(read16(d, tt.lba, tt.n))
+		if ok != tt.ok {
+			t.Errorf("READ(16) of %d at %d: ok is %v", tt.n, tt.lba, ok)
+		}
+		if !ok && (resp.Status() != scsi.SamStatCheckCondition ||
+			resp.senseBuffer[2] != scsi.SenseIllegalRequest ||
+			binary.BigEndian.Uint16(resp.senseBuffer[12:14]) != scsi.AscLbaOutOfRange) {
+			t.Errorf("READ(16) of %d at %d: status 0x%02x, sense % x", tt.n, tt.lba, resp.Status(), resp.senseBuffer)
+		}
+	}
+}
+
+func TestCheckLBARangeNoBlockSize(t *testing.T) {
+	d := testDevice(OSFS{})
+	d.scsi.DataSizes = DataSizes{VolumeSize: 100 * 512}
+	if resp, ok := CheckLBARange(read16(d, 0, 1)); ok || resp.Status() != scsi.SamStatCheckCondition {
+		t.Errorf("ok is %v, status 0x%02x", ok, resp.Status())
+	}
+	inquiry := &SCSICmd{cdb: []byte{scsi.Inquiry, 0, 0, 0, 36, 0}, device: d}
+	if _, ok := CheckLBARange(inquiry); !ok {
+		t.Errorf("INQUIRY failed")
+	}
+}
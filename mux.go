@@ -0,0 +1,299 @@
+package tcmu
+
+import (
+	"encoding/binary"
+	"sort"
+	"sync"
+
+	"github.com/coreos/go-tcmu/scsi"
+)
+
+// SCSICmdHandlerFunc lets an ordinary function be used as a SCSICmdHandler.
+type SCSICmdHandlerFunc func(cmd *SCSICmd) (SCSIResponse, error)
+
+// HandleCommand calls f(cmd).
+func (f SCSICmdHandlerFunc) HandleCommand(cmd *SCSICmd) (SCSIResponse, error) {
+	return f(cmd)
+}
+
+// hasServiceAction reports whether commands with opcode op carry a service
+// action.
+func hasServiceAction(op byte) bool {
+	switch op {
+	case scsi.MaintenanceIn, scsi.MaintenanceOut,
+		scsi.ServiceActionIn12, scsi.ServiceActionOut12,
+		scsi.ServiceActionIn16, scsi.ServiceActionOut16,
+		scsi.ServiceActionBidirectional,
+		scsi.PersistentReserveIn, scsi.PersistentReserveOut,
+		scsi.VariableLengthCmd:
+		return true
+	}
+	return false
+}
+
+// ServiceAction returns the service action of the command, for the opcodes
+// that have one, such as MAINTENANCE IN or SERVICE ACTION IN(16). It is zero
+// for the others.
+func (c *SCSICmd) ServiceAction() uint16 {
+	op := c.Command()
+	if !hasServiceAction(op) {
+		return 0
+	}
+	if op == scsi.VariableLengthCmd {
+		return binary.BigEndian.Uint16(c.cdb[8:10])
+	}
+	return uint16(c.cdb[1] & 0x1f)
+}
+
+// opcodeCdbLen returns the length of the CDB for opcode op, as CdbLen does,
+// taking variable length commands to be 32 bytes.
+func opcodeCdbLen(op byte) int {
+	switch {
+	case op <= 0x1f:
+		return 6
+	case op <= 0x5f:
+		return 10
+	case op == scsi.VariableLengthCmd:
+		return 32
+	case op >= 0x80 && op <= 0x9f:
+		return 16
+	case op >= 0xa0 && op <= 0xbf:
+		return 12
+	}
+	return 0
+}
+
+type muxKey struct {
+	op byte
+	sa uint16
+	// hasSA is set for registrations of a single service action.
+	hasSA bool
+}
+
+// CmdMux is a SCSICmdHandler that routes each command to the handler
+// registered for its opcode, or for its opcode and service action. Commands
+// without a handler get NotHandled. REPORT SUPPORTED OPERATION CODES is
+// answered from the registrations, unless a handler is registered for it.
+//
+// Handlers may be registered while the mux is serving commands.
+type CmdMux struct {
+	mu       sync.RWMutex
+	handlers map[muxKey]SCSICmdHandler
+}
+
+// NewCmdMux returns a CmdMux with nothing registered.
+func NewCmdMux() *CmdMux {
+	return &CmdMux{handlers: make(map[muxKey]SCSICmdHandler)}
+}
+
+// NewDefaultCmdMux returns a CmdMux with every Emulate function registered,
+// serving reads and writes from rw, as ReadWriterAtCmdHandler does. A nil inq
+// means the default inquiry data.
+func NewDefaultCmdMux(rw ReadWriterAt, inq *InquiryInfo) *CmdMux {
+	if inq == nil {
+		inq = &defaultInquiry
+	}
+	m := NewCmdMux()
+	m.HandleFunc(scsi.Inquiry, func(cmd *SCSICmd) (SCSIResponse, error) {
+		return EmulateInquiry(cmd, inq)
+	})
+	m.HandleFunc(scsi.TestUnitReady, EmulateTestUnitReady)
+	m.HandleServiceActionFunc(scsi.ServiceActionIn16, scsi.SaiReadCapacity16, EmulateReadCapacity16)
+	modeSense := func(cmd *SCSICmd) (SCSIResponse, error) {
+		return EmulateModeSense(cmd, false)
+	}
+	m.HandleFunc(scsi.ModeSense, modeSense)
+	m.HandleFunc(scsi.ModeSense10, modeSense)
+	modeSelect := func(cmd *SCSICmd) (SCSIResponse, error) {
+		return EmulateModeSelect(cmd, false)
+	}
+	m.HandleFunc(scsi.ModeSelect, modeSelect)
+	m.HandleFunc(scsi.ModeSelect10, modeSelect)
+	read := func(cmd *SCSICmd) (SCSIResponse, error) {
+		return EmulateRead(cmd, rw)
+	}
+	for _, op := range []byte{scsi.Read6, scsi.Read10, scsi.Read12, scsi.Read16} {
+		m.HandleFunc(op, read)
+	}
+	write := func(cmd *SCSICmd) (SCSIResponse, error) {
+		return EmulateWrite(cmd, rw)
+	}
+	for _, op := range []byte{scsi.Write6, scsi.Write10, scsi.Write12, scsi.Write16} {
+		m.HandleFunc(op, write)
+	}
+	m.HandleServiceActionFunc(scsi.MaintenanceIn, scsi.MiReportTargetPgs, EmulateReportTargetPortGroups)
+	m.HandleServiceActionFunc(scsi.MaintenanceOut, scsi.MoSetTargetPgs, EmulateSetTargetPortGroups)
+	return m
+}
+
+// Handle registers h for every command with opcode op, whatever its service
+// action, unless a handler is registered for that service action.
+func (m *CmdMux) Handle(op byte, h SCSICmdHandler) {
+	m.register(muxKey{op: op}, h)
+}
+
+// HandleFunc registers f for opcode op, as Handle does.
+func (m *CmdMux) HandleFunc(op byte, f func(*SCSICmd) (SCSIResponse, error)) {
+	m.Handle(op, SCSICmdHandlerFunc(f))
+}
+
+// HandleServiceAction registers h for commands with opcode op and service
+// action sa.
+func (m *CmdMux) HandleServiceAction(op byte, sa uint16, h SCSICmdHandler) {
+	m.register(muxKey{op: op, sa: sa, hasSA: true}, h)
+}
+
+// HandleServiceActionFunc registers f for opcode op and service action sa, as
+// HandleServiceAction does.
+func (m *CmdMux) HandleServiceActionFunc(op byte, sa uint16, f func(*SCSICmd) (SCSIResponse, error)) {
+	m.HandleServiceAction(op, sa, SCSICmdHandlerFunc(f))
+}
+
+func (m *CmdMux) register(k muxKey, h SCSICmdHandler) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.handlers == nil {
+		m.handlers = make(map[muxKey]SCSICmdHandler)
+	}
+	if h == nil {
+		delete(m.handlers, k)
+		return
+	}
+	m.handlers[k] = h
+}
+
+// handler finds the handler for a command. found is false if nothing is
+// registered for the opcode at all.
+func (m *CmdMux) handler(op byte, sa uint16) (h SCSICmdHandler, found bool) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	if hasServiceAction(op) {
+		if h, ok := m.handlers[muxKey{op: op, sa: sa, hasSA: true}]; ok {
+			return h, true
+		}
+	}
+	if h, ok := m.handlers[muxKey{op: op}]; ok {
+		return h, true
+	}
+	if hasServiceAction(op) {
+		for k := range m.handlers {
+			if k.op == op {
+				return nil, true
+			}
+		}
+	}
+	return nil, false
+}
+
+// HandleCommand routes cmd to its handler.
+func (m *CmdMux) HandleCommand(cmd *SCSICmd) (SCSIResponse, error) {
+	op, sa := cmd.Command(), cmd.ServiceAction()
+	h, found := m.handler(op, sa)
+	if h != nil {
+		return h.HandleCommand(cmd)
+	}
+	if op == scsi.MaintenanceIn && sa == scsi.MiReportSupportedOperationCodes {
+		return m.reportSupportedOperationCodes(cmd)
+	}
+	if found {
+		// The opcode is known, but not this service action.
+		return cmd.IllegalRequest(), nil
+	}
+	return cmd.NotHandled(), nil
+}
+
+// supported lists the registrations, as the opcodes and service actions
+// REPORT SUPPORTED OPERATION CODES reports, sorted.
+func (m *CmdMux) supported() []muxKey {
+	m.mu.RLock()
+	keys := make([]muxKey, 0, len(m.handlers)+1)
+	for k := range m.handlers {
+		keys = append(keys, k)
+	}
+	m.mu.RUnlock()
+	rsoc := muxKey{op: scsi.MaintenanceIn, sa: scsi.MiReportSupportedOperationCodes, hasSA: true}
+	if !containsKey(keys, rsoc) {
+		keys = append(keys, rsoc)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].op != keys[j].op {
+			return keys[i].op < keys[j].op
+		}
+		return keys[i].sa < keys[j].sa
+	})
+	return keys
+}
+
+func containsKey(keys []muxKey, k muxKey) bool {
+	for _, x := range keys {
+		if x == k {
+			return true
+		}
+	}
+	return false
+}
+
+// reportSupportedOperationCodes answers REPORT SUPPORTED OPERATION CODES from
+// the registrations. Command timeouts descriptors aren't supported.
+func (m *CmdMux) reportSupportedOperationCodes(cmd *SCSICmd) (SCSIResponse, error) {
+	order := binary.BigEndian
+	options := cmd.GetCDB(2) & 0x07
+	reqOp := cmd.GetCDB(3)
+	reqSA := order.Uint16(cmd.cdb[4:6])
+	keys := m.supported()
+
+	var data []byte
+	switch options {
+	case 0: // all commands
+		data = make([]byte, 4)
+		for _, k := range keys {
+			desc := make([]byte, 8)
+			desc[0] = k.op
+			if k.hasSA {
+				order.PutUint16(desc[2:4], k.sa)
+				desc[5] = 0x01 // SERVACTV
+			}
+			order.PutUint16(desc[6:8], uint16(opcodeCdbLen(k.op)))
+			data = append(data, desc...)
+		}
+		order.PutUint32(data[0:4], uint32(len(data)-4))
+	case 1, 2, 3: // one command
+		if (options == 1 && hasServiceAction(reqOp)) || (options == 2 && !hasServiceAction(reqOp)) {
+			return cmd.IllegalRequest(), nil
+		}
+		wantSA := hasServiceAction(reqOp) && options != 1
+		supported := false
+		for _, k := range keys {
+			if k.op == reqOp && (!k.hasSA || (wantSA && k.sa == reqSA)) {
+				supported = true
+			}
+		}
+		n := opcodeCdbLen(reqOp)
+		data = make([]byte, 4)
+		data[1] = 0x01 // not supported
+		if supported && n > 0 {
+			data[1] = 0x03 // supported
+			order.PutUint16(data[2:4], uint16(n))
+			// CDB usage data: every bit the command might use.
+			usage := make([]byte, n)
+			for i := range usage {
+				usage[i] = 0xff
+			}
+			usage[0] = reqOp
+			if wantSA && reqOp != scsi.VariableLengthCmd {
+				usage[1] = byte(reqSA & 0x1f)
+			}
+			data = append(data, usage...)
+		}
+	default:
+		return cmd.IllegalRequest(), nil
+	}
+
+	if alloc := int(cmd.XferLen()); alloc < len(data) {
+		data = data[:alloc]
+	}
+	if _, err := cmd.Write(data); err != nil {
+		return SCSIResponse{}, err
+	}
+	return cmd.Ok(), nil
+}
@@ -0,0 +1,538 @@
+package tcmu
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/common/log"
+	"golang.org/x/sys/unix"
+)
+
+const (
+	tcmuGenlFamily  = "TCM-USER"
+	tcmuGenlMcGroup = "config"
+	tcmuGenlVersion = 2
+
+	// genlHdrLen is the size of struct genlmsghdr: cmd, version and two
+	// reserved bytes.
+	genlHdrLen = 4
+)
+
+/*
+enum tcmu_genl_cmd {
+	TCMU_CMD_UNSPEC,
+	TCMU_CMD_ADDED_DEVICE,
+	TCMU_CMD_REMOVED_DEVICE,
+	TCMU_CMD_RECONFIG_DEVICE,
+	TCMU_CMD_SET_FEATURES,
+	TCMU_CMD_ADDED_DEVICE_DONE,
+	TCMU_CMD_REMOVED_DEVICE_DONE,
+	TCMU_CMD_RECONFIG_DEVICE_DONE,
+	__TCMU_CMD_MAX,
+};
+*/
+const (
+	tcmuCmdUnspec = iota
+	tcmuCmdAddedDevice
+	tcmuCmdRemovedDevice
+	tcmuCmdReconfigDevice
+	tcmuCmdSetFeatures
+	tcmuCmdAddedDeviceDone
+	tcmuCmdRemovedDeviceDone
+	tcmuCmdReconfigDeviceDone
+)
+
+/*
+enum tcmu_genl_attr {
+	TCMU_ATTR_UNSPEC,
+	TCMU_ATTR_DEVICE,
+	TCMU_ATTR_MINOR,
+	TCMU_ATTR_PAD,
+	TCMU_ATTR_DEV_CFG,
+	TCMU_ATTR_DEV_SIZE,
+	TCMU_ATTR_WRITECACHE,
+	TCMU_ATTR_CMD_STATUS,
+	TCMU_ATTR_DEVICE_ID,
+	TCMU_ATTR_SUPP_KERN_CMD_REPLY,
+	__TCMU_ATTR_MAX,
+};
+*/
+const (
+	tcmuAttrUnspec = iota
+	tcmuAttrDevice
+	tcmuAttrMinor
+	tcmuAttrPad
+	tcmuAttrDevCfg
+	tcmuAttrDevSize
+	tcmuAttrWriteCache
+	tcmuAttrCmdStatus
+	tcmuAttrDeviceID
+	tcmuAttrSuppKernCmdReply
+)
+
+// netlinkConn is a generic netlink socket, as far as NetlinkListener is
+// concerned. Receive returns one datagram, which may hold several messages.
+type netlinkConn interface {
+	Send(b []byte) error
+	Receive() ([]byte, error)
+	Close() error
+}
+
+// errNetlinkClosed is returned by Receive once the connection is closed.
+var errNetlinkClosed = errors.New("netlink connection closed")
+
+// NetlinkListener listens to the kernel's TCM-USER generic netlink family and
+// replies to the ADDED, REMOVED and RECONFIG device events it sends for the
+// devices registered with it. Reconfiguration is routed to the OnResize,
+// OnWriteCacheChange and OnConfigChange callbacks of each device's
+// SCSIHandler.
+//
+// Newer kernels wait for these replies before finishing a configfs change, so
+// one listener should be shared by all the devices a process serves, and set
+// as their SCSIHandler's Netlink before they are opened.
+type NetlinkListener struct {
+	conn   netlinkConn
+	family uint16
+
+	mu      sync.Mutex
+	seq     uint32
+	devices map[string]*Device
+	done    chan struct{}
+}
+
+// NewNetlinkListener opens a generic netlink socket, joins the TCM-USER
+// family's multicast group and tells the kernel that replies to its events
+// are supported.
+func NewNetlinkListener() (*NetlinkListener, error) {
+	conn, err := dialNetlink(unix.NETLINK_GENERIC, 0)
+	if err != nil {
+		return nil, err
+	}
+	family, group, err := resolveGenlFamily(conn, tcmuGenlFamily, tcmuGenlMcGroup)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if err := conn.join(group); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return newNetlinkListener(conn, family)
+}
+
+func newNetlinkListener(conn netlinkConn, family uint16) (*NetlinkListener, error) {
+	l := &NetlinkListener{
+		conn:    conn,
+		family:  family,
+		seq:     1,
+		devices: make(map[string]*Device),
+		done:    make(chan struct{}),
+	}
+	attrs := appendNlAttr(nil, tcmuAttrSuppKernCmdReply, []byte{1})
+	if err := conn.Send(l.genlMsg(tcmuCmdSetFeatures, attrs)); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	go l.run()
+	return l, nil
+}
+
+// Close stops listening. Devices still registered will no longer have their
+// events acknowledged.
+func (l *NetlinkListener) Close() error {
+	err := l.conn.Close()
+	<-l.done
+	return err
+}
+
+func netlinkKey(hba int, volume string) string {
+	return fmt.Sprintf("%d/%s", hba, volume)
+}
+
+func (l *NetlinkListener) register(d *Device) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.devices[netlinkKey(d.scsi.HBA, d.scsi.VolumeName)] = d
+}
+
+func (l *NetlinkListener) unregister(d *Device) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	key := netlinkKey(d.scsi.HBA, d.scsi.VolumeName)
+	if l.devices[key] == d {
+		delete(l.devices, key)
+	}
+}
+
+// lookup finds the device for a TCMU_ATTR_DEVICE name, which is the UIO
+// device's name: "tcm-user/<hba>/<volume>/<dev_config>".
+func (l *NetlinkListener) lookup(name string) *Device {
+	split := strings.SplitN(name, "/", 4)
+	if len(split) < 3 || split[0] != "tcm-user" {
+		return nil
+	}
+	hba, err := strconv.Atoi(split[1])
+	if err != nil {
+		return nil
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.devices[netlinkKey(hba, split[2])]
+}
+
+func (l *NetlinkListener) genlMsg(cmd uint8, attrs []byte) []byte {
+	l.mu.Lock()
+	l.seq++
+	seq := l.seq
+	l.mu.Unlock()
+	return newGenlMsg(l.family, unix.NLM_F_REQUEST, seq, cmd, tcmuGenlVersion, attrs)
+}
+
+func (l *NetlinkListener) run() {
+	defer close(l.done)
+	for {
+		b, err := l.conn.Receive()
+		if err == errNetlinkClosed {
+			return
+		}
+		if err != nil {
+			log.Errorf("error receiving from netlink: %s", err)
+			return
+		}
+		msgs, err := parseNlMsgs(b)
+		if err != nil {
+			log.Errorf("error parsing netlink message: %s", err)
+			continue
+		}
+		for _, m := range msgs {
+			l.handle(m)
+		}
+	}
+}
+
+func (l *NetlinkListener) handle(m nlMsg) {
+	if m.typ == unix.NLMSG_ERROR {
+		if len(m.data) >= 4 {
+			if errno := int32(byteOrder.Uint32(m.data)); errno != 0 {
+				log.Errorf("netlink request failed: %s", unix.Errno(-errno))
+			}
+		}
+		return
+	}
+	if m.typ != l.family || len(m.data) < genlHdrLen {
+		return
+	}
+	cmd := m.data[0]
+	attrs, err := parseNlAttrs(m.data[genlHdrLen:])
+	if err != nil {
+		log.Errorf("error parsing TCM-USER attributes: %s", err)
+		return
+	}
+	d := l.lookup(attrs.str(tcmuAttrDevice))
+	if d == nil {
+		// Somebody else's device.
+		return
+	}
+	var done uint8
+	var status error
+	switch cmd {
+	case tcmuCmdAddedDevice:
+		done = tcmuCmdAddedDeviceDone
+	case tcmuCmdRemovedDevice:
+		done = tcmuCmdRemovedDeviceDone
+	case tcmuCmdReconfigDevice:
+		done = tcmuCmdReconfigDeviceDone
+		status = d.reconfigure(attrs)
+	default:
+		log.Debugf("ignoring TCM-USER command %d", cmd)
+		return
+	}
+	var errno int32
+	if status != nil {
+		log.Errorf("refusing reconfiguration of %s: %s", d.scsi.VolumeName, status)
+		errno = -int32(unix.EINVAL)
+	}
+	reply := appendNlAttr(nil, tcmuAttrCmdStatus, nlUint32(uint32(errno)))
+	reply = appendNlAttr(reply, tcmuAttrDeviceID, attrs[tcmuAttrDeviceID])
+	if err := l.conn.Send(l.genlMsg(done, reply)); err != nil {
+		log.Errorf("error replying to TCM-USER command %d: %s", cmd, err)
+	}
+}
+
+// reconfigure passes a RECONFIG_DEVICE event on to the handler's callbacks,
+// and applies the change to the device if they accept it. Every change the
+// event asks for is checked before any callback runs, and the device is only
+// changed once all of them have accepted; if one refuses, OnResize is called
+// again with the old size.
+func (d *Device) reconfigure(attrs nlAttrs) error {
+	size, resize := attrs[tcmuAttrDevSize]
+	wce, setWCE := attrs[tcmuAttrWriteCache]
+	_, setCfg := attrs[tcmuAttrDevCfg]
+	switch {
+	case resize && d.scsi.OnResize == nil:
+		return errors.New("resizing is not supported")
+	case resize && len(size) < 8:
+		return fmt.Errorf("bad dev_size attribute of %d bytes", len(size))
+	case setWCE && d.scsi.OnWriteCacheChange == nil:
+		return errors.New("changing the write cache is not supported")
+	case setWCE && len(wce) < 1:
+		return errors.New("empty write cache attribute")
+	case setCfg && d.scsi.OnConfigChange == nil:
+		return errors.New("changing dev_config is not supported")
+	}
+
+	if resize {
+		if err := d.scsi.OnResize(int64(byteOrder.Uint64(size))); err != nil {
+			return err
+		}
+	}
+	// If a later callback refuses, the handler is told the size is back to
+	// what it was, as the kernel will keep it.
+	undoResize := func() {
+		if !resize {
+			return
+		}
+		if err := d.scsi.OnResize(d.Sizes().VolumeSize); err != nil {
+			log.Errorf("error undoing resize of %s: %s", d.scsi.VolumeName, err)
+		}
+	}
+	if setWCE {
+		if err := d.scsi.OnWriteCacheChange(wce[0] != 0); err != nil {
+			undoResize()
+			return err
+		}
+	}
+	if setCfg {
+		if err := d.scsi.OnConfigChange(attrs.str(tcmuAttrDevCfg)); err != nil {
+			undoResize()
+			return err
+		}
+	}
+	if resize {
+		d.sizesMu.Lock()
+		d.scsi.DataSizes.VolumeSize = int64(byteOrder.Uint64(size))
+		d.sizesMu.Unlock()
+	}
+	return nil
+}
+
+// resolveGenlFamily asks the generic netlink controller for the id of a
+// family and of one of its multicast groups.
+func resolveGenlFamily(conn netlinkConn, name, group string) (uint16, uint32, error) {
+	attrs := appendNlAttr(nil, unix.CTRL_ATTR_FAMILY_NAME, append([]byte(name), 0))
+	req := newGenlMsg(unix.GENL_ID_CTRL, unix.NLM_F_REQUEST, 1, unix.CTRL_CMD_GETFAMILY, 1, attrs)
+	if err := conn.Send(req); err != nil {
+		return 0, 0, err
+	}
+	b, err := conn.Receive()
+	if err != nil {
+		return 0, 0, err
+	}
+	msgs, err := parseNlMsgs(b)
+	if err != nil {
+		return 0, 0, err
+	}
+	for _, m := range msgs {
+		if m.typ == unix.NLMSG_ERROR && len(m.data) >= 4 {
+			return 0, 0, fmt.Errorf("resolving generic netlink family %s: %s (is target_core_user loaded?)", name, unix.Errno(-int32(byteOrder.Uint32(m.data))))
+		}
+		if m.typ != unix.GENL_ID_CTRL || len(m.data) < genlHdrLen {
+			continue
+		}
+		fattrs, err := parseNlAttrs(m.data[genlHdrLen:])
+		if err != nil {
+			return 0, 0, err
+		}
+		id, ok := fattrs[unix.CTRL_ATTR_FAMILY_ID]
+		if !ok || len(id) < 2 {
+			continue
+		}
+		groups, err := parseNlAttrs(fattrs[unix.CTRL_ATTR_MCAST_GROUPS])
+		if err != nil {
+			return 0, 0, err
+		}
+		for _, g := range groups {
+			gattrs, err := parseNlAttrs(g)
+			if err != nil {
+				return 0, 0, err
+			}
+			if gattrs.str(unix.CTRL_ATTR_MCAST_GRP_NAME) == group && len(gattrs[unix.CTRL_ATTR_MCAST_GRP_ID]) >= 4 {
+				return byteOrder.Uint16(id), byteOrder.Uint32(gattrs[unix.CTRL_ATTR_MCAST_GRP_ID]), nil
+			}
+		}
+		return 0, 0, fmt.Errorf("generic netlink family %s has no multicast group %s", name, group)
+	}
+	return 0, 0, fmt.Errorf("no reply resolving generic netlink family %s", name)
+}
+
+type nlMsg struct {
+	typ   uint16
+	flags uint16
+	seq   uint32
+	data  []byte
+}
+
+func nlAlign(n int) int {
+	return (n + unix.NLA_ALIGNTO - 1) &^ (unix.NLA_ALIGNTO - 1)
+}
+
+func parseNlMsgs(b []byte) ([]nlMsg, error) {
+	var out []nlMsg
+	for len(b) >= unix.NLMSG_HDRLEN {
+		l := int(byteOrder.Uint32(b[0:4]))
+		if l < unix.NLMSG_HDRLEN || l > len(b) {
+			return out, fmt.Errorf("bad netlink message length %d", l)
+		}
+		out = append(out, nlMsg{
+			typ:   byteOrder.Uint16(b[4:6]),
+			flags: byteOrder.Uint16(b[6:8]),
+			seq:   byteOrder.Uint32(b[8:12]),
+			data:  b[unix.NLMSG_HDRLEN:l],
+		})
+		if nlAlign(l) >= len(b) {
+			break
+		}
+		b = b[nlAlign(l):]
+	}
+	return out, nil
+}
+
+func newGenlMsg(typ uint16, flags uint16, seq uint32, cmd uint8, version uint8, attrs []byte) []byte {
+	l := unix.NLMSG_HDRLEN + genlHdrLen + len(attrs)
+	b := make([]byte, unix.NLMSG_HDRLEN+genlHdrLen, l)
+	byteOrder.PutUint32(b[0:4], uint32(l))
+	byteOrder.PutUint16(b[4:6], typ)
+	byteOrder.PutUint16(b[6:8], flags)
+	byteOrder.PutUint32(b[8:12], seq)
+	b[unix.NLMSG_HDRLEN] = cmd
+	b[unix.NLMSG_HDRLEN+1] = version
+	return append(b, attrs...)
+}
+
+// nlAttrs maps netlink attribute types to their payloads.
+type nlAttrs map[uint16][]byte
+
+func (a nlAttrs) str(typ uint16) string {
+	return strings.TrimRight(string(a[typ]), "\x00")
+}
+
+func parseNlAttrs(b []byte) (nlAttrs, error) {
+	out := make(nlAttrs)
+	for len(b) >= unix.NLA_HDRLEN {
+		l := int(byteOrder.Uint16(b[0:2]))
+		if l < unix.NLA_HDRLEN || l > len(b) {
+			return out, fmt.Errorf("bad netlink attribute length %d", l)
+		}
+		// Strip NLA_F_NESTED and NLA_F_NET_BYTEORDER.
+		typ := byteOrder.Uint16(b[2:4]) & 0x3fff
+		out[typ] = b[unix.NLA_HDRLEN:l]
+		if nlAlign(l) >= len(b) {
+			break
+		}
+		b = b[nlAlign(l):]
+	}
+	return out, nil
+}
+
+func appendNlAttr(b []byte, typ uint16, data []byte) []byte {
+	l := unix.NLA_HDRLEN + len(data)
+	hdr := make([]byte, unix.NLA_HDRLEN)
+	byteOrder.PutUint16(hdr[0:2], uint16(l))
+	byteOrder.PutUint16(hdr[2:4], typ)
+	b = append(b, hdr...)
+	b = append(b, data...)
+	return append(b, make([]byte, nlAlign(l)-l)...)
+}
+
+func nlUint32(v uint32) []byte {
+	b := make([]byte, 4)
+	byteOrder.PutUint32(b, v)
+	return b
+}
+
+// socketConn is a netlinkConn on a real AF_NETLINK socket.
+type socketConn struct {
+	fd int
+
+	mu      sync.Mutex
+	reading bool
+	closed  bool
+}
+
+// netlinkRecvTimeout is how often a blocked Receive checks whether the
+// socket has been closed underneath it.
+const netlinkRecvTimeout = 500 * time.Millisecond
+
+// dialNetlink opens a netlink socket for the given protocol, bound to the
+// given multicast groups.
+func dialNetlink(proto int, groups uint32) (*socketConn, error) {
+	fd, err := unix.Socket(unix.AF_NETLINK, unix.SOCK_RAW|unix.SOCK_CLOEXEC, proto)
+	if err != nil {
+		return nil, err
+	}
+	if err := unix.Bind(fd, &unix.SockaddrNetlink{Family: unix.AF_NETLINK, Groups: groups}); err != nil {
+		unix.Close(fd)
+		return nil, err
+	}
+	tv := unix.NsecToTimeval(netlinkRecvTimeout.Nanoseconds())
+	if err := unix.SetsockoptTimeval(fd, unix.SOL_SOCKET, unix.SO_RCVTIMEO, &tv); err != nil {
+		unix.Close(fd)
+		return nil, err
+	}
+	return &socketConn{fd: fd}, nil
+}
+
+func (c *socketConn) join(group uint32) error {
+	return unix.SetsockoptInt(c.fd, unix.SOL_NETLINK, unix.NETLINK_ADD_MEMBERSHIP, int(group))
+}
+
+func (c *socketConn) Send(b []byte) error {
+	return unix.Sendto(c.fd, b, 0, &unix.SockaddrNetlink{Family: unix.AF_NETLINK})
+}
+
+func (c *socketConn) Receive() ([]byte, error) {
+	b := make([]byte, 16*1024)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for {
+		if c.closed {
+			c.closeFd()
+			return nil, errNetlinkClosed
+		}
+		c.reading = true
+		c.mu.Unlock()
+		n, _, err := unix.Recvfrom(c.fd, b, 0)
+		c.mu.Lock()
+		c.reading = false
+		if err == unix.EAGAIN || err == unix.EINTR {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		return b[:n], nil
+	}
+}
+
+// Close closes the socket. If a Receive is blocked on it, that Receive closes
+// it once it times out, so the fd can't be reused underneath it.
+func (c *socketConn) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.closed = true
+	if !c.reading {
+		c.closeFd()
+	}
+	return nil
+}
+
+func (c *socketConn) closeFd() {
+	if c.fd != -1 {
+		unix.Close(c.fd)
+		c.fd = -1
+	}
+}
@@ -0,0 +1,332 @@
+package tcmu
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+const testFamily = 0x20
+
+// fakeNetlinkConn is a netlinkConn that delivers the datagrams pushed into
+// recv, and records what is sent.
+type fakeNetlinkConn struct {
+	recv chan []byte
+	sent chan []byte
+	done chan struct{}
+}
+
+func newFakeNetlinkConn() *fakeNetlinkConn {
+	return &fakeNetlinkConn{
+		recv: make(chan []byte, 16),
+		sent: make(chan []byte, 16),
+		done: make(chan struct{}),
+	}
+}
+
+func (c *fakeNetlinkConn) Send(b []byte) error {
+	c.sent <- append([]byte(nil), b...)
+	return nil
+}
+
+func (c *fakeNetlinkConn) Receive() ([]byte, error) {
+	select {
+	case b := <-c.recv:
+		return b, nil
+	case <-c.done:
+		return nil, errNetlinkClosed
+	}
+}
+
+func (c *fakeNetlinkConn) Close() error {
+	select {
+	case <-c.done:
+	default:
+		close(c.done)
+	}
+	return nil
+}
+
+// next returns the next message sent, parsed as a TCM-USER reply.
+func (c *fakeNetlinkConn) next(t *testing.T) (uint8, nlAttrs) {
+	t.Helper()
+	select {
+	case b := <-c.sent:
+		msgs, err := parseNlMsgs(b)
+		if err != nil || len(msgs) != 1 {
+			t.Fatalf("sent %d messages, err %v", len(msgs), err)
+		}
+		m := msgs[0]
+		if m.typ != testFamily || len(m.data) < genlHdrLen {
+			t.Fatalf("sent message of type %d, %d bytes", m.typ, len(m.data))
+		}
+		attrs, err := parseNlAttrs(m.data[genlHdrLen:])
+		if err != nil {
+			t.Fatal(err)
+		}
+		return m.data[0], attrs
+	case <-time.After(5 * time.Second):
+		t.Fatal("nothing sent")
+	}
+	return 0, nil
+}
+
+func (c *fakeNetlinkConn) nothingSent(t *testing.T) {
+	t.Helper()
+	select {
+	case <-c.sent:
+		t.Fatal("unexpected reply")
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func startTestListener(t *testing.T, h *SCSIHandler) (*fakeNetlinkConn, *Device) {
+	t.Helper()
+	conn := newFakeNetlinkConn()
+	l, err := newNetlinkListener(conn, testFamily)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	if cmd, attrs := conn.next(t); cmd != tcmuCmdSetFeatures || len(attrs[tcmuAttrSuppKernCmdReply]) != 1 {
+		t.Fatalf("first message is command %d, attrs %v; want SET_FEATURES", cmd, attrs)
+	}
+	if h.HBA == 0 {
+		h.HBA = 30
+	}
+	if h.VolumeName == "" {
+		h.VolumeName = "vol"
+	}
+	h.Netlink = l
+	d := newDevice("/dev/test", h)
+	l.register(d)
+	return conn, d
+}
+
+func kernelEvent(cmd uint8, device string, id uint32, extra ...[]byte) []byte {
+	attrs := appendNlAttr(nil, tcmuAttrDevice, append([]byte(device), 0))
+	attrs = appendNlAttr(attrs, tcmuAttrDeviceID, nlUint32(id))
+	for _, e := range extra {
+		attrs = append(attrs, e...)
+	}
+	return newGenlMsg(testFamily, 0, 7, cmd, tcmuGenlVersion, attrs)
+}
+
+func checkReply(t *testing.T, conn *fakeNetlinkConn, wantCmd uint8, wantID uint32, wantErrno unix.Errno) {
+	t.Helper()
+	cmd, attrs := conn.next(t)
+	if cmd != wantCmd {
+		t.Errorf("reply command %d, want %d", cmd, wantCmd)
+	}
+	if len(attrs[tcmuAttrCmdStatus]) != 4 {
+		t.Fatalf("reply has no CMD_STATUS: %v", attrs)
+	}
+	if status := int32(byteOrder.Uint32(attrs[tcmuAttrCmdStatus])); status != -int32(wantErrno) {
+		t.Errorf("reply status %d, want %d", status, -int32(wantErrno))
+	}
+	if len(attrs[tcmuAttrDeviceID]) != 4 {
+		t.Fatalf("reply has no DEVICE_ID: %v", attrs)
+	}
+	if id := byteOrder.Uint32(attrs[tcmuAttrDeviceID]); id != wantID {
+		t.Errorf("reply device id %d, want %d", id, wantID)
+	}
+}
+
+func u64Attr(typ uint16, v uint64) []byte {
+	b := make([]byte, 8)
+	byteOrder.PutUint64(b, v)
+	return appendNlAttr(nil, typ, b)
+}
+
+const testDevName = "tcm-user/30/vol/go-tcmu//vol"
+
+func TestNetlinkAddedRemoved(t *testing.T) {
+	conn, _ := startTestListener(t, &SCSIHandler{})
+	conn.recv <- kernelEvent(tcmuCmdAddedDevice, testDevName, 11)
+	checkReply(t, conn, tcmuCmdAddedDeviceDone, 11, 0)
+	conn.recv <- kernelEvent(tcmuCmdRemovedDevice, testDevName, 12)
+	checkReply(t, conn, tcmuCmdRemovedDeviceDone, 12, 0)
+}
+
+func TestNetlinkOtherDevice(t *testing.T) {
+	conn, _ := startTestListener(t, &SCSIHandler{})
+	conn.recv <- kernelEvent(tcmuCmdAddedDevice, "tcm-user/31/vol/go-tcmu//vol", 1)
+	conn.recv <- kernelEvent(tcmuCmdAddedDevice, "not-tcmu", 2)
+	conn.nothingSent(t)
+}
+
+func TestNetlinkReconfig(t *testing.T) {
+	var resized int64
+	var wce *bool
+	var cfg string
+	conn, d := startTestListener(t, &SCSIHandler{
+		DataSizes: DataSizes{VolumeSize: 1 << 20, BlockSize: 512},
+		OnResize: func(size int64) error {
+			resized = size
+			return nil
+		},
+		OnWriteCacheChange: func(enabled bool) error {
+			wce = &enabled
+			return nil
+		},
+		OnConfigChange: func(config string) error {
+			cfg = config
+			return nil
+		},
+	})
+
+	conn.recv <- kernelEvent(tcmuCmdReconfigDevice, testDevName, 3, u64Attr(tcmuAttrDevSize, 2<<20))
+	checkReply(t, conn, tcmuCmdReconfigDeviceDone, 3, 0)
+	if resized != 2<<20 || d.Sizes().VolumeSize != 2<<20 {
+		t.Errorf("resized to %d, device size %d; want %d", resized, d.Sizes().VolumeSize, 2<<20)
+	}
+
+	conn.recv <- kernelEvent(tcmuCmdReconfigDevice, testDevName, 4, appendNlAttr(nil, tcmuAttrWriteCache, []byte{1}))
+	checkReply(t, conn, tcmuCmdReconfigDeviceDone, 4, 0)
+	if wce == nil || !*wce {
+		t.Errorf("write cache change not passed on")
+	}
+
+	conn.recv <- kernelEvent(tcmuCmdReconfigDevice, testDevName, 5, appendNlAttr(nil, tcmuAttrDevCfg, []byte("go-tcmu//other\x00")))
+	checkReply(t, conn, tcmuCmdReconfigDeviceDone, 5, 0)
+	if cfg != "go-tcmu//other" {
+		t.Errorf("config change to %q", cfg)
+	}
+}
+
+func TestNetlinkReconfigRefused(t *testing.T) {
+	for _, tt := range []struct {
+		name string
+		h    SCSIHandler
+		attr []byte
+	}{
+		{"no OnResize", SCSIHandler{}, u64Attr(tcmuAttrDevSize, 2<<20)},
+		{"no OnWriteCacheChange", SCSIHandler{}, appendNlAttr(nil, tcmuAttrWriteCache, []byte{1})},
+		{"no OnConfigChange", SCSIHandler{}, appendNlAttr(nil, tcmuAttrDevCfg, []byte("x\x00"))},
+		{"OnResize refuses", SCSIHandler{
+			OnResize: func(int64) error { return errors.New("no") },
+		}, u64Attr(tcmuAttrDevSize, 2<<20)},
+		{"OnWriteCacheChange refuses", SCSIHandler{
+			OnWriteCacheChange: func(bool) error { return errors.New("no") },
+		}, appendNlAttr(nil, tcmuAttrWriteCache, []byte{0})},
+		{"OnConfigChange refuses", SCSIHandler{
+			OnConfigChange: func(string) error { return errors.New("no") },
+		}, appendNlAttr(nil, tcmuAttrDevCfg, []byte("x\x00"))},
+		{"short dev_size", SCSIHandler{
+			OnResize: func(int64) error { return nil },
+		}, appendNlAttr(nil, tcmuAttrDevSize, []byte{1, 2})},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			h := tt.h
+			h.DataSizes = DataSizes{VolumeSize: 1 << 20, BlockSize: 512}
+			conn, d := startTestListener(t, &h)
+			conn.recv <- kernelEvent(tcmuCmdReconfigDevice, testDevName, 9, tt.attr)
+			checkReply(t, conn, tcmuCmdReconfigDeviceDone, 9, unix.EINVAL)
+			if d.Sizes().VolumeSize != 1<<20 {
+				t.Errorf("size changed to %d", d.Sizes().VolumeSize)
+			}
+		})
+	}
+}
+
+func TestNetlinkReconfigAllOrNothing(t *testing.T) {
+	var sizes []int64
+	conn, d := startTestListener(t, &SCSIHandler{
+		DataSizes: DataSizes{VolumeSize: 1 << 20, BlockSize: 512},
+		OnResize: func(size int64) error {
+			sizes = append(sizes, size)
+			return nil
+		},
+		OnWriteCacheChange: func(bool) error { return errors.New("no") },
+	})
+	attrs := append(u64Attr(tcmuAttrDevSize, 2<<20), appendNlAttr(nil, tcmuAttrWriteCache, []byte{1})...)
+	conn.recv <- kernelEvent(tcmuCmdReconfigDevice, testDevName, 6, attrs)
+	checkReply(t, conn, tcmuCmdReconfigDeviceDone, 6, unix.EINVAL)
+	if d.Sizes().VolumeSize != 1<<20 {
+		t.Errorf("size changed to %d despite the refusal", d.Sizes().VolumeSize)
+	}
+	if len(sizes) != 2 || sizes[1] != 1<<20 {
+		t.Errorf("OnResize called with %v, want the resize undone", sizes)
+	}
+
+	// Nothing runs if a callback is missing.
+	sizes = nil
+	d.scsi.OnWriteCacheChange = nil
+	conn.recv <- kernelEvent(tcmuCmdReconfigDevice, testDevName, 7, attrs)
+	checkReply(t, conn, tcmuCmdReconfigDeviceDone, 7, unix.EINVAL)
+	if len(sizes) != 0 {
+		t.Errorf("OnResize called with %v", sizes)
+	}
+}
+
+func TestParseNlMsgs(t *testing.T) {
+	good := newGenlMsg(testFamily, 0, 1, tcmuCmdAddedDevice, 2, appendNlAttr(nil, tcmuAttrDeviceID, nlUint32(1)))
+	two := append(append([]byte(nil), good...), good...)
+	msgs, err := parseNlMsgs(two)
+	if err != nil || len(msgs) != 2 {
+		t.Fatalf("two messages: got %d, err %v", len(msgs), err)
+	}
+
+	for _, tt := range []struct {
+		name string
+		b    []byte
+	}{
+		{"length past the end", func() []byte {
+			b := append([]byte(nil), good...)
+			byteOrder.PutUint32(b[0:4], uint32(len(b)+4))
+			return b
+		}()},
+		{"length shorter than the header", func() []byte {
+			b := append([]byte(nil), good...)
+			byteOrder.PutUint32(b[0:4], 4)
+			return b
+		}()},
+		{"truncated second message", two[:len(two)-4]},
+	} {
+		if _, err := parseNlMsgs(tt.b); err == nil {
+			t.Errorf("%s: no error", tt.name)
+		}
+	}
+
+	if msgs, err := parseNlMsgs(good[:unix.NLMSG_HDRLEN-1]); err != nil || len(msgs) != 0 {
+		t.Errorf("short datagram: got %d messages, err %v", len(msgs), err)
+	}
+}
+
+func TestParseNlAttrs(t *testing.T) {
+	b := appendNlAttr(nil, tcmuAttrDevice, []byte("abc\x00"))
+	b = appendNlAttr(b, tcmuAttrDeviceID|0x8000, nlUint32(5))
+	attrs, err := parseNlAttrs(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if attrs.str(tcmuAttrDevice) != "abc" {
+		t.Errorf("device %q", attrs.str(tcmuAttrDevice))
+	}
+	if id := attrs[tcmuAttrDeviceID]; len(id) != 4 || byteOrder.Uint32(id) != 5 {
+		t.Errorf("flagged attribute not found: %v", attrs)
+	}
+
+	for _, tt := range []struct {
+		name string
+		b    []byte
+	}{
+		{"length past the end", func() []byte {
+			b := appendNlAttr(nil, tcmuAttrDevice, []byte("abc\x00"))
+			byteOrder.PutUint16(b[0:2], uint16(len(b)+4))
+			return b
+		}()},
+		{"length shorter than the header", func() []byte {
+			b := appendNlAttr(nil, tcmuAttrDevice, []byte("abc\x00"))
+			byteOrder.PutUint16(b[0:2], 2)
+			return b
+		}()},
+		{"truncated payload", appendNlAttr(nil, tcmuAttrDevice, []byte("abcdefgh"))[:8]},
+	} {
+		if _, err := parseNlAttrs(tt.b); err == nil {
+			t.Errorf("%s: no error", tt.name)
+		}
+	}
+}
@@ -0,0 +1,85 @@
+package tcmu
+
+import (
+	"fmt"
+	"path"
+	"strings"
+)
+
+// Nexus identifies the I_T nexus a command came through: the initiator port
+// and the target port. The kernel doesn't pass it to TCMU with each command,
+// so it is worked out from how the device is exported. That is exact for
+// fabrics with a single initiator, such as loopback and vhost, and for iSCSI
+// targets with one ACL and no demo mode. Otherwise Initiator is empty, and
+// only the target port is known.
+type Nexus struct {
+	// Fabric is the LIO fabric, eg "loopback", "iscsi" or "vhost". It is
+	// empty for fabrics that don't implement NexusFabric.
+	Fabric string
+	// Initiator is the initiator port's name, such as an IQN or a NAA WWN,
+	// if it is known.
+	Initiator string
+	// Target is the target port's name, and TPG its portal group tag.
+	Target string
+	TPG    int
+	// RelativePort is the relative target port identifier, as VPD page
+	// 0x83 reports it.
+	RelativePort uint16
+}
+
+func (n Nexus) String() string {
+	initiator := n.Initiator
+	if initiator == "" {
+		initiator = "?"
+	}
+	return fmt.Sprintf("%s %s -> %s,%d", n.Fabric, initiator, n.Target, n.TPG)
+}
+
+// NexusFabric is implemented by fabrics that can tell which I_T nexus their
+// commands arrive through.
+type NexusFabric interface {
+	Fabric
+	Nexus(d *Device) Nexus
+}
+
+// Nexus returns the I_T nexus of the command; see Nexus for how much of it
+// can be known.
+func (c *SCSICmd) Nexus() Nexus {
+	return c.device.Nexus()
+}
+
+// Nexus returns the I_T nexus the device's commands come through. It is zero
+// until the device has been exported.
+func (d *Device) Nexus() Nexus {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.nexus
+}
+
+// resolveNexus works out the device's nexus, once the fabric has exported it.
+func (d *Device) resolveNexus() {
+	var n Nexus
+	f := d.fabric()
+	if nf, ok := f.(NexusFabric); ok {
+		n = nf.Nexus(d)
+	}
+	if lp, ok := f.(lunPather); ok {
+		n.RelativePort = d.relativePort(lp.LUNPath(d))
+	}
+	d.mu.Lock()
+	d.nexus = n
+	d.mu.Unlock()
+}
+
+// readNexus returns the initiator port name in a loopback or vhost TPG's
+// nexus file, or def if it can't be read.
+func readNexus(fs FS, tpg, def string) string {
+	b, err := fs.ReadFile(path.Join(tpg, "nexus"))
+	if err != nil {
+		return def
+	}
+	if s := strings.TrimSpace(string(b)); s != "" {
+		return s
+	}
+	return def
+}
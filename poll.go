@@ -1,7 +1,10 @@
 package tcmu
 
 import (
+	"context"
 	"fmt"
+	"sync/atomic"
+	"time"
 
 	"github.com/coreos/go-tcmu/scsi"
 	"github.com/prometheus/common/log"
@@ -12,16 +15,101 @@ const (
 	tcmuSenseBufferSize = 96
 )
 
+// startPoll sets up the epoll instance watching the UIO fd, along with the
+// eventfd used to stop the loop, and starts polling the command ring.
+func (d *Device) startPoll() (err error) {
+	d.eventFd, err = unix.Eventfd(0, unix.EFD_CLOEXEC|unix.EFD_NONBLOCK)
+	if err != nil {
+		return err
+	}
+	d.epollFd, err = unix.EpollCreate1(unix.EPOLL_CLOEXEC)
+	if err != nil {
+		return err
+	}
+	for _, fd := range []int{d.uioFd, d.eventFd} {
+		ev := unix.EpollEvent{Events: unix.EPOLLIN, Fd: int32(fd)}
+		if err := unix.EpollCtl(d.epollFd, unix.EPOLL_CTL_ADD, fd, &ev); err != nil {
+			return err
+		}
+	}
+	d.pollDone = make(chan struct{})
+	d.respDone = make(chan struct{})
+	d.respStop = make(chan struct{})
+	go d.beginPoll()
+	return nil
+}
+
+// stopPoll stops the poll loop, which closes cmdChan, then waits for the
+// handlers to send their last responses and for those to be completed. If
+// ctx is done first, the loop stays stopped and a later call resumes waiting.
+// After failInFlight, the handlers it gave up on aren't waited for: responses
+// stop being read once the rest are completed.
+func (d *Device) stopPoll(ctx context.Context) error {
+	if d.pollDone == nil {
+		return nil
+	}
+	buf := make([]byte, 8)
+	byteOrder.PutUint64(buf, 1)
+	if _, err := unix.Write(d.eventFd, buf); err != nil {
+		log.Errorf("error stopping poll: %s", err)
+	}
+	if err := waitDone(ctx, d.pollDone); err != nil {
+		return err
+	}
+	d.mu.Lock()
+	forced := d.forced
+	d.mu.Unlock()
+	if forced {
+		// Polling has stopped, so nothing new can start. Once the BUSY
+		// responses are completed, stop reading the late ones.
+		if err := waitDone(ctx, d.settled()); err != nil {
+			return err
+		}
+		select {
+		case <-d.respStop:
+		default:
+			close(d.respStop)
+		}
+	}
+	if err := waitDone(ctx, d.respDone); err != nil {
+		return err
+	}
+	d.pollDone = nil
+	d.respDone = nil
+	return nil
+}
+
+func waitDone(ctx context.Context, done chan struct{}) error {
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return fmt.Errorf("waiting for in-flight commands: %v", ctx.Err())
+	}
+}
+
 func (d *Device) beginPoll() {
 	// Entry point for the goroutine.
+	defer close(d.pollDone)
 	go d.recvResponse()
 	buf := make([]byte, 4)
+	events := make([]unix.EpollEvent, 2)
 	for {
-		var n int
-		var err error
-		n, err = unix.Read(d.uioFd, buf)
-		if n == -1 && err != nil {
-			fmt.Println(err)
+		n, err := unix.EpollWait(d.epollFd, events, -1)
+		if err == unix.EINTR {
+			continue
+		}
+		if err != nil {
+			log.Errorf("error polling: %s", err)
+			break
+		}
+		if d.stopRequested(events[:n]) {
+			break
+		}
+		// Acknowledge the interrupt. The fd is non-blocking, and a previous
+		// pass over the ring may already have picked up these commands.
+		if _, err := unix.Read(d.uioFd, buf); err != nil && err != unix.EAGAIN {
+			log.Errorf("error reading uio: %s", err)
 			break
 		}
 		for {
@@ -33,21 +121,53 @@ func (d *Device) beginPoll() {
 			if cmd == nil {
 				break
 			}
-			d.cmdChan <- cmd
+			atomic.AddUint64(&d.stats.commands, 1)
+			d.dispatch(cmd)
 		}
 	}
 	close(d.cmdChan)
 }
 
+func (d *Device) stopRequested(events []unix.EpollEvent) bool {
+	for _, ev := range events {
+		if int(ev.Fd) == d.eventFd {
+			return true
+		}
+	}
+	return false
+}
+
 func (d *Device) recvResponse() {
+	defer close(d.respDone)
 	var n int
 	buf := make([]byte, 4)
-	for resp := range d.respChan {
+	c := newCoalescer(d.scsi.CompletionWindow)
+	for {
+		var resp SCSIResponse
+		select {
+		case r, ok := <-d.respChan:
+			if !ok {
+				return
+			}
+			resp = r
+		case <-d.respStop:
+			return
+		}
+		if d.dropped(resp.id) {
+			continue
+		}
 		err := d.completeCommand(resp)
 		if err != nil {
 			log.Errorf("error completing command: %s", err)
 			return
 		}
+		batch, err := d.completeBatch(c)
+		if err != nil {
+			log.Errorf("error completing command: %s", err)
+			return
+		}
+		atomic.AddUint64(&d.stats.completions, uint64(batch))
+		atomic.AddUint64(&d.stats.notifications, 1)
 		/* Tell the fd there's something new */
 		n, err = unix.Write(d.uioFd, buf)
 		if n == -1 && err != nil {
@@ -57,7 +177,95 @@ func (d *Device) recvResponse() {
 	}
 }
 
+// completeBatch completes every response that is already waiting on respChan,
+// and, if the coalescer asks for it, those arriving within its window. It
+// returns the size of the batch, including the response already completed by
+// the caller.
+func (d *Device) completeBatch(c *coalescer) (int, error) {
+	batch := 1 + d.drainResponses()
+	wait := c.window(batch)
+	if wait == 0 {
+		return batch, nil
+	}
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	extra := 0
+	for {
+		select {
+		case resp, ok := <-d.respChan:
+			if !ok {
+				c.update(extra)
+				return batch + extra, nil
+			}
+			if err := d.completeCommand(resp); err != nil {
+				return batch + extra, err
+			}
+			extra += 1 + d.drainResponses()
+		case <-timer.C:
+			c.update(extra)
+			return batch + extra, nil
+		}
+	}
+}
+
+// drainResponses completes the responses that can be received from respChan
+// without blocking, and returns how many there were.
+func (d *Device) drainResponses() int {
+	n := 0
+	for {
+		select {
+		case resp, ok := <-d.respChan:
+			if !ok {
+				return n
+			}
+			if err := d.completeCommand(resp); err != nil {
+				log.Errorf("error completing command: %s", err)
+				return n
+			}
+			n++
+		default:
+			return n
+		}
+	}
+}
+
+// coalescer decides how long to hold back a batch of completions before
+// notifying the kernel. It only waits once a batch shows that responses are
+// arriving concurrently, doubling its window while waiting pays off and
+// halving it while it doesn't.
+type coalescer struct {
+	max time.Duration
+	cur time.Duration
+}
+
+func newCoalescer(max time.Duration) *coalescer {
+	return &coalescer{max: max, cur: max}
+}
+
+func (c *coalescer) window(batch int) time.Duration {
+	if c.max <= 0 || batch < 2 {
+		return 0
+	}
+	return c.cur
+}
+
+func (c *coalescer) update(extra int) {
+	if extra > 0 {
+		c.cur *= 2
+		if c.cur > c.max {
+			c.cur = c.max
+		}
+		return
+	}
+	if c.cur > c.max/16 {
+		c.cur /= 2
+	}
+}
+
 func (d *Device) completeCommand(resp SCSIResponse) error {
+	if d.dropped(resp.id) {
+		return nil
+	}
 	off := d.tailEntryOff()
 	for d.entHdrOp(off) != tcmuOpCmd {
 		d.mbSetTail((d.mbCmdTail() + uint32(d.entHdrGetLen(off))) % d.mbCmdrSize())
@@ -71,6 +279,7 @@ func (d *Device) completeCommand(resp SCSIResponse) error {
 		d.copyEntRespSenseData(off, resp.senseBuffer)
 	}
 	d.mbSetTail((d.mbCmdTail() + uint32(d.entHdrGetLen(off))) % d.mbCmdrSize())
+	d.untrack(resp.id)
 	return nil
 }
 
@@ -88,6 +297,7 @@ func (d *Device) getNextCommand() (*SCSICmd, error) {
 				id:     d.entCmdId(off),
 				device: d,
 			}
+			out.ctx, out.cancel = context.WithCancel(context.Background())
 			out.cdb = d.entCdb(off)
 			vecs := int(d.entReqIovCnt(off))
 			out.vecs = make([][]byte, vecs)
@@ -97,6 +307,10 @@ func (d *Device) getNextCommand() (*SCSICmd, error) {
 			}
 			d.cmdTail = (d.cmdTail + uint32(d.entHdrGetLen(off))) % d.mbCmdrSize()
 			return out, nil
+		} else if d.entHdrOp(off) == tcmuOpTmr {
+			// Nothing to complete; the tail skips over it like a pad.
+			d.handleTMR(off)
+			d.cmdTail = (d.cmdTail + uint32(d.entHdrGetLen(off))) % d.mbCmdrSize()
 		} else {
 			panic(fmt.Sprintf("unsupported command from tcmu? %d", d.entHdrOp(off)))
 		}
@@ -184,6 +184,12 @@ const (
 	AscMiscompareDuringVerifyOperation = 0x1d00
 	AscInvalidFieldInCdb               = 0x2400
 	AscInvalidFieldInParameterList     = 0x2600
+	AscLbaOutOfRange                   = 0x2100
+	AscWriteProtected                  = 0x2700
+	AscAsymmetricAccessStateChanged    = 0x2a06
+	AscLunNotAccessibleTransitioning   = 0x040a
+	AscLunNotAccessibleStandby         = 0x040b
+	AscLunNotAccessibleUnavailable     = 0x040c
 )
 
 /*
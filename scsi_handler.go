@@ -1,6 +1,7 @@
 package tcmu
 
 import (
+	"context"
 	"crypto/md5"
 	"encoding/binary"
 	"encoding/hex"
@@ -8,6 +9,7 @@ import (
 	"fmt"
 	"io"
 	"sync"
+	"time"
 
 	"github.com/coreos/go-tcmu/scsi"
 	"github.com/prometheus/common/log"
@@ -21,8 +23,11 @@ type SCSICmd struct {
 	offset    int
 	vecoffset int
 	device    *Device
+	ctx       context.Context
+	cancel    context.CancelFunc
 
 	// Buf, if provided, may be used as a scratch buffer for copying data to and from the kernel.
+	// Without it, the Emulate functions use buffers from the device's pool; see GetBuffer.
 	Buf []byte
 }
 
@@ -57,11 +62,7 @@ func (c *SCSICmd) LBA() uint64 {
 
 	switch c.CdbLen() {
 	case 6:
-		val6 := uint8(order.Uint16(c.cdb[2:4]))
-		if val6 == 0 {
-			return 256
-		}
-		return uint64(val6)
+		return uint64(c.cdb[1]&0x1f)<<16 | uint64(order.Uint16(c.cdb[2:4]))
 	case 10:
 		return uint64(order.Uint32(c.cdb[2:6]))
 	case 12:
@@ -79,6 +80,10 @@ func (c *SCSICmd) XferLen() uint32 {
 	order := binary.BigEndian
 	switch c.CdbLen() {
 	case 6:
+		// READ(6) and WRITE(6) use zero for 256 blocks.
+		if c.cdb[4] == 0 && (c.cdb[0] == scsi.Read6 || c.cdb[0] == scsi.Write6) {
+			return 256
+		}
 		return uint32(c.cdb[4])
 	case 10:
 		return uint32(order.Uint16(c.cdb[7:9]))
@@ -92,6 +97,15 @@ func (c *SCSICmd) XferLen() uint32 {
 	}
 }
 
+// dataLen returns the size of the data buffer the kernel gave the command.
+func (c *SCSICmd) dataLen() int {
+	n := 0
+	for _, v := range c.vecs {
+		n += len(v)
+	}
+	return n
+}
+
 // Write, for a SCSICmd, is a io.Writer to the data buffer attached to this SCSI command.
 // It's writing *to* the buffer, which happens most commonly when responding to Read commands (take data and write it back to the kernel buffer)
 func (c *SCSICmd) Write(b []byte) (n int, err error) {
@@ -134,6 +148,17 @@ func (c *SCSICmd) Read(b []byte) (n int, err error) {
 	return boff, nil
 }
 
+// Context returns the command's context. It is cancelled if the kernel aborts
+// the command, for instance because it timed out or the LUN was reset, and
+// once the command has been completed. An aborted command must still be
+// responded to; the response is simply discarded.
+func (c *SCSICmd) Context() context.Context {
+	if c.ctx == nil {
+		return context.Background()
+	}
+	return c.ctx
+}
+
 // Device accesses the details of the SCSI device this command is handling.
 func (c *SCSICmd) Device() *Device {
 	return c.device
@@ -222,6 +247,11 @@ type SCSIResponse struct {
 	senseBuffer []byte
 }
 
+// Status returns the SCSI status of the response.
+func (r SCSIResponse) Status() byte {
+	return r.status
+}
+
 // SCSIHandler is the high-level data for the emulated SCSI device.
 type SCSIHandler struct {
 	// The volume name and resultant device name.
@@ -234,10 +264,76 @@ type SCSIHandler struct {
 	LUN int
 	// The SCSI World Wide Identifer for the device
 	WWN WWN
+	// Fabric exports the device to initiators. Nil means a LoopbackFabric.
+	Fabric Fabric
+	// ALUAGroups, if any, are the backstore's target port groups, for
+	// multipath initiators. The device emulates ALUA for them.
+	ALUAGroups []ALUAGroup
+	// Attributes are the LIO attributes to give the backstore; by default
+	// the kernel's own defaults are kept.
+	Attributes DeviceAttributes
+	// FS is how the device reaches configfs, sysfs and /dev. Nil means the
+	// running system's, at their usual paths.
+	FS FS
 	// Called once the device is ready. Should spawn a goroutine (or several)
 	// to handle commands coming in the first channel, and send their associated
 	// responses down the second channel, ordering optional.
 	DevReady DevReadyFunc
+	// CmdHandler, if DevReady is nil, handles the commands on a pool of
+	// workers, which the device grows while commands queue up and shrinks
+	// again once they're idle. There are at least MinWorkers of them, one if
+	// it is zero, and at most MaxWorkers, the kernel's queue depth if it is
+	// zero.
+	CmdHandler SCSICmdHandler
+	MinWorkers int
+	MaxWorkers int
+	// CompletionWindow, if non-zero, is the longest the device will hold back
+	// completed commands so that the kernel can be notified of them in a
+	// single batch. The window adapts to the load: it is only used while
+	// several responses are arriving together, and shrinks when waiting
+	// doesn't pick up any more of them.
+	CompletionWindow time.Duration
+	// DrainTimeout is how long Shutdown waits for in-flight commands to
+	// complete once the device stops accepting new ones. Zero means ten
+	// seconds.
+	DrainTimeout time.Duration
+
+	// Netlink, if set, acknowledges the kernel's events for this device, and
+	// routes reconfiguration requests to the callbacks below. The kernel is
+	// told to wait for those replies, so the listener must keep running for
+	// as long as the device exists.
+	Netlink *NetlinkListener
+	// OnResize is called when dev_size is changed through configfs, with the
+	// new size in bytes. Returning an error, or leaving it nil, refuses the
+	// change.
+	OnResize func(size int64) error
+	// OnWriteCacheChange is called when emulate_write_cache is changed
+	// through configfs. Returning an error, or leaving it nil, refuses the
+	// change.
+	OnWriteCacheChange func(enabled bool) error
+	// OnConfigChange is called when dev_config is changed through configfs.
+	// Returning an error, or leaving it nil, refuses the change.
+	OnConfigChange func(config string) error
+
+	// OnLUNReset is called when the kernel notifies the device of a LUN or
+	// target reset, after the contexts of the aborted commands have been
+	// cancelled. It should clear any reservations and unit attentions the
+	// handler keeps. Notifications need a kernel with TMR support.
+	OnLUNReset func()
+
+	// OnFatal is called, from the worker, when the handler returns an error
+	// for a command. The command itself fails with a hardware error, and the
+	// worker carries on with the next one. The error is a *HandlerError.
+	OnFatal func(err error)
+	// FenceOnError fences the device at the first handler error: from then
+	// on every command fails with a hardware error without reaching the
+	// handler, so that a backend in an unknown state can't corrupt the
+	// volume. Device.Fenced reports it.
+	FenceOnError bool
+
+	// uevents, if set, is the uevent socket the device shares with the
+	// other devices of its Manager.
+	uevents *ueventHub
 }
 
 type DevReadyFunc func(chan *SCSICmd, chan SCSIResponse) error
@@ -327,20 +423,15 @@ func BasicSCSIHandler(rw ReadWriterAt) *SCSIHandler {
 func SingleThreadedDevReady(h SCSICmdHandler) DevReadyFunc {
 	return func(in chan *SCSICmd, out chan SCSIResponse) error {
 		go func(h SCSICmdHandler, in chan *SCSICmd, out chan SCSIResponse) {
-			// Use io.Copy's trick
-			buf := make([]byte, 32*1024)
 			for {
 				v, ok := <-in
 				if !ok {
 					close(out)
 					return
 				}
-				v.Buf = buf
 				x, err := h.HandleCommand(v)
-				buf = v.Buf
 				if err != nil {
-					log.Error(err)
-					return
+					x = v.Device().handlerFailed(v, err)
 				}
 				out <- x
 			}
@@ -356,18 +447,14 @@ func MultiThreadedDevReady(h SCSICmdHandler, threads int) DevReadyFunc {
 			w.Add(threads)
 			for i := 0; i < threads; i++ {
 				go func(h SCSICmdHandler, in chan *SCSICmd, out chan SCSIResponse, w *sync.WaitGroup) {
-					buf := make([]byte, 32*1024)
 					for {
 						v, ok := <-in
 						if !ok {
 							break
 						}
-						v.Buf = buf
 						x, err := h.HandleCommand(v)
-						buf = v.Buf
 						if err != nil {
-							log.Error(err)
-							return
+							x = v.Device().handlerFailed(v, err)
 						}
 						out <- x
 					}
@@ -0,0 +1,55 @@
+package tcmu
+
+import "sync/atomic"
+
+// DeviceStats is a snapshot of the counters a Device keeps while it is running.
+type DeviceStats struct {
+	// Commands is the number of SCSI commands read from the command ring.
+	Commands uint64
+	// Completions is the number of responses written back to the command ring.
+	Completions uint64
+	// Notifications is the number of times the kernel was told about new
+	// completions. Completions/Notifications is the average batch size.
+	Notifications uint64
+	// InFlight is the number of commands handed to the handlers and not yet
+	// completed.
+	InFlight int
+	// Workers is the number of workers running the handler's CmdHandler. It
+	// is zero for handlers with their own DevReady.
+	Workers int
+	// BufferBytes is how much memory the device's scratch buffers handed
+	// out hold, and BufferLimit the size of the kernel data area. Past the
+	// limit, buffers are allocated outside the pool instead of from it, so
+	// BufferBytes only goes beyond BufferLimit while those are out.
+	BufferBytes int64
+	BufferLimit int
+	// BufferAllocs is the number of scratch buffers the pool has had to
+	// allocate, rather than reuse, including those past the limit.
+	BufferAllocs uint64
+}
+
+type deviceStats struct {
+	commands      uint64
+	completions   uint64
+	notifications uint64
+}
+
+// Stats returns a snapshot of the device's counters.
+func (d *Device) Stats() DeviceStats {
+	d.mu.Lock()
+	inflight := len(d.inflight)
+	d.mu.Unlock()
+	s := DeviceStats{
+		Commands:      atomic.LoadUint64(&d.stats.commands),
+		Completions:   atomic.LoadUint64(&d.stats.completions),
+		Notifications: atomic.LoadUint64(&d.stats.notifications),
+		InFlight:      inflight,
+		Workers:       d.workers.size(),
+	}
+	if p := d.buffers; p != nil {
+		s.BufferBytes = atomic.LoadInt64(&p.inUse)
+		s.BufferLimit = p.limit
+		s.BufferAllocs = atomic.LoadUint64(&p.allocs)
+	}
+	return s
+}
@@ -41,6 +41,7 @@ func (d *Device) mbSetTail(u uint32) {
 enum tcmu_opcode {
   TCMU_OP_PAD = 0,
   TCMU_OP_CMD,
+  TCMU_OP_TMR,
 };
 */
 type tcmuOpcode int
@@ -48,6 +49,7 @@ type tcmuOpcode int
 const (
 	tcmuOpPad tcmuOpcode = 0
 	tcmuOpCmd            = 1
+	tcmuOpTmr            = 2
 )
 
 /*
@@ -182,3 +184,29 @@ func (d *Device) cdbLen(cdbStart int) int {
 		panic(fmt.Sprintf("what opcode is %x", opcode))
 	}
 }
+
+/*
+struct tcmu_tmr_entry {
+	struct tcmu_cmd_entry_hdr hdr;
+
+	__u8 tmr_type;
+	__u8 __pad1;
+	__u16 __pad2;
+	__u32 cmd_cnt;
+	__u64 __pad3;
+	__u64 __pad4;
+	__u16 cmd_ids[0];
+} __packed;
+*/
+
+func (d *Device) entTmrType(off int) uint8 {
+	return d.mmap[off+offTmrType]
+}
+
+func (d *Device) entTmrCmdCnt(off int) uint32 {
+	return *(*uint32)(unsafe.Pointer(&d.mmap[off+offTmrCmdCnt]))
+}
+
+func (d *Device) entTmrCmdIdN(off int, idx int) uint16 {
+	return *(*uint16)(unsafe.Pointer(&d.mmap[off+offTmrCmdIds+2*idx]))
+}
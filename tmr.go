@@ -0,0 +1,79 @@
+package tcmu
+
+import (
+	"github.com/prometheus/common/log"
+)
+
+// TMRType is the kind of task management request the kernel is notifying
+// the device about.
+type TMRType uint8
+
+/*
+enum tcmu_tmr_type {
+	TCMU_TMR_UNKNOWN = 0,
+	TCMU_TMR_ABORT_TASK = 1,
+	TCMU_TMR_ABORT_TASK_SET = 2,
+	TCMU_TMR_CLEAR_ACA = 3,
+	TCMU_TMR_CLEAR_TASK_SET = 4,
+	TCMU_TMR_LUN_RESET = 5,
+	TCMU_TMR_TARGET_WARM_RESET = 6,
+	TCMU_TMR_TARGET_COLD_RESET = 7,
+	// Pseudo reset due to received PR OUT
+	TCMU_TMR_LUN_RESET_PRO = 128,
+};
+*/
+const (
+	TMRUnknown         TMRType = 0
+	TMRAbortTask       TMRType = 1
+	TMRAbortTaskSet    TMRType = 2
+	TMRClearACA        TMRType = 3
+	TMRClearTaskSet    TMRType = 4
+	TMRLUNReset        TMRType = 5
+	TMRTargetWarmReset TMRType = 6
+	TMRTargetColdReset TMRType = 7
+	// TMRLUNResetPro is a pseudo LUN reset, caused by a PERSISTENT RESERVE
+	// OUT command.
+	TMRLUNResetPro TMRType = 128
+)
+
+// resetsLUN reports whether the request resets the logical unit, as opposed
+// to just aborting some of its commands.
+func (t TMRType) resetsLUN() bool {
+	switch t {
+	case TMRLUNReset, TMRTargetWarmReset, TMRTargetColdReset, TMRLUNResetPro:
+		return true
+	}
+	return false
+}
+
+// tmrNotificationAttr is the backstore attribute that makes the kernel put
+// TMR entries in the command ring. Kernels without it don't support them.
+const tmrNotificationAttr = "attrib/tmr_notification"
+
+// handleTMR reads the TMR entry at off. The commands it names have been
+// aborted by the kernel, so their contexts are cancelled; the kernel still
+// expects them to be completed, and won't reuse their ids until they are.
+func (d *Device) handleTMR(off int) {
+	tmr := TMRType(d.entTmrType(off))
+	n := int(d.entTmrCmdCnt(off))
+	ids := make([]uint16, n)
+	for i := 0; i < n; i++ {
+		ids[i] = d.entTmrCmdIdN(off, i)
+	}
+	log.Debugf("TMR %d aborts commands %v", tmr, ids)
+	d.cancel(ids)
+	if tmr.resetsLUN() && d.scsi.OnLUNReset != nil {
+		d.scsi.OnLUNReset()
+	}
+}
+
+// cancel cancels the contexts of the given in-flight commands.
+func (d *Device) cancel(ids []uint16) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for _, id := range ids {
+		if c, ok := d.inflight[id]; ok && c.cancel != nil {
+			c.cancel()
+		}
+	}
+}
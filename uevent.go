@@ -0,0 +1,310 @@
+package tcmu
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"golang.org/x/sys/unix"
+)
+
+// ueventKernelGroup is the multicast group the kernel sends uevents to, as
+// opposed to the one udev rebroadcasts them on.
+const ueventKernelGroup = 1
+
+// uevent is a kobject event, as the kernel sends it on a
+// NETLINK_KOBJECT_UEVENT socket.
+type uevent struct {
+	Action    string
+	DevPath   string
+	Subsystem string
+	DevType   string
+	DevName   string
+	Major     uint32
+	Minor     uint32
+	// Env holds every variable of the event, including the ones above.
+	Env map[string]string
+}
+
+// parseUevent parses a message from the kernel: an "action@devpath" header,
+// followed by NUL-terminated KEY=value variables. Messages from udev, which
+// start with "libudev", are rejected.
+func parseUevent(b []byte) (*uevent, error) {
+	fields := bytes.Split(b, []byte{0})
+	if !bytes.Contains(fields[0], []byte("@")) {
+		return nil, fmt.Errorf("not a kernel uevent: %q", fields[0])
+	}
+	u := &uevent{Env: make(map[string]string)}
+	for _, f := range fields[1:] {
+		kv := strings.SplitN(string(f), "=", 2)
+		if len(kv) != 2 {
+			continue
+		}
+		u.Env[kv[0]] = kv[1]
+	}
+	u.Action = u.Env["ACTION"]
+	u.DevPath = u.Env["DEVPATH"]
+	u.Subsystem = u.Env["SUBSYSTEM"]
+	u.DevType = u.Env["DEVTYPE"]
+	u.DevName = u.Env["DEVNAME"]
+	if u.Action == "" || u.DevPath == "" {
+		return nil, fmt.Errorf("uevent %q has no action or devpath", fields[0])
+	}
+	for _, n := range []struct {
+		key string
+		p   *uint32
+	}{{"MAJOR", &u.Major}, {"MINOR", &u.Minor}} {
+		s, ok := u.Env[n.key]
+		if !ok {
+			continue
+		}
+		v, err := strconv.ParseUint(s, 10, 32)
+		if err != nil {
+			return nil, fmt.Errorf("uevent %q has invalid %s: %v", fields[0], n.key, err)
+		}
+		*n.p = uint32(v)
+	}
+	return u, nil
+}
+
+// scsiDisk reports whether u announces the disk of the SCSI device at
+// address, given as "host:channel:target".
+func (u *uevent) scsiDisk(address string) bool {
+	if u.Action != "add" || u.Subsystem != "block" || u.DevType != "disk" || u.DevName == "" {
+		return false
+	}
+	parts := strings.Split(u.DevPath, "/")
+	for i := 0; i+1 < len(parts); i++ {
+		if strings.HasPrefix(parts[i], address+":") && parts[i+1] == "block" {
+			return true
+		}
+	}
+	return false
+}
+
+// ueventHub reads the kernel's uevents from one socket, and passes each on
+// to every watcher. A Manager shares one between its devices, so that the
+// many opening at once don't each have a socket, and each parse every event.
+// The socket is opened for the first watcher, and closed after the last.
+type ueventHub struct {
+	// dial opens the socket. Nil means a NETLINK_KOBJECT_UEVENT socket on
+	// the kernel's group.
+	dial func() (netlinkConn, error)
+
+	mu       sync.Mutex
+	conn     netlinkConn
+	watchers map[*ueventWatcher]bool
+}
+
+// ueventWatcher delivers the kernel's uevents until it is closed.
+type ueventWatcher struct {
+	hub    *ueventHub
+	events chan *uevent
+}
+
+func (h *ueventHub) watch() (*ueventWatcher, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.conn == nil {
+		dial := h.dial
+		if dial == nil {
+			dial = func() (netlinkConn, error) {
+				return dialNetlink(unix.NETLINK_KOBJECT_UEVENT, ueventKernelGroup)
+			}
+		}
+		conn, err := dial()
+		if err != nil {
+			return nil, err
+		}
+		h.conn = conn
+		h.watchers = make(map[*ueventWatcher]bool)
+		go h.run(conn, h.watchers)
+	}
+	w := &ueventWatcher{hub: h, events: make(chan *uevent, 16)}
+	h.watchers[w] = true
+	return w, nil
+}
+
+func (h *ueventHub) run(conn netlinkConn, watchers map[*ueventWatcher]bool) {
+	defer func() {
+		h.mu.Lock()
+		defer h.mu.Unlock()
+		for w := range watchers {
+			close(w.events)
+		}
+		if h.conn == conn {
+			h.conn = nil
+			conn.Close()
+		}
+	}()
+	for {
+		b, err := conn.Receive()
+		if err == errNetlinkClosed {
+			return
+		}
+		if err == unix.ENOBUFS {
+			// Some were dropped; whoever is waiting falls back on sysfs.
+			continue
+		}
+		if err != nil {
+			logrus.Errorf("Failed to receive uevent: %v", err)
+			return
+		}
+		u, err := parseUevent(b)
+		if err != nil {
+			logrus.Debugf("Ignoring uevent: %v", err)
+			continue
+		}
+		h.mu.Lock()
+		for w := range watchers {
+			select {
+			case w.events <- u:
+			default:
+				// It's behind, and falls back on sysfs like any other
+				// watcher that misses an event.
+			}
+		}
+		h.mu.Unlock()
+	}
+}
+
+// Events returns the channel uevents are delivered on. It is closed if the
+// socket fails. A nil watcher has a nil channel, which never delivers.
+func (w *ueventWatcher) Events() <-chan *uevent {
+	if w == nil {
+		return nil
+	}
+	return w.events
+}
+
+func (w *ueventWatcher) Close() {
+	if w == nil {
+		return
+	}
+	h := w.hub
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if !h.watchers[w] {
+		return
+	}
+	delete(h.watchers, w)
+	if len(h.watchers) == 0 && h.conn != nil {
+		h.conn.Close()
+		h.conn = nil
+	}
+}
+
+// blockDevice is the kernel's disk for a loopback-exported device.
+type blockDevice struct {
+	name         string
+	major, minor uint32
+}
+
+// BlockDevicePath returns the kernel's own node for the device's disk, eg
+// "/dev/sdb". It is only known for the loopback fabric, and empty otherwise.
+func (d *Device) BlockDevicePath() string {
+	if d.blockDev == nil {
+		return ""
+	}
+	return path.Join(devRoot, d.blockDev.name)
+}
+
+// BlockDeviceNumber returns the major and minor numbers of the device's
+// disk, if BlockDevicePath knows it.
+func (d *Device) BlockDeviceNumber() (major, minor uint32) {
+	if d.blockDev == nil {
+		return 0, 0
+	}
+	return d.blockDev.major, d.blockDev.minor
+}
+
+// findBlockDevice waits for the kernel to create the disk for the device's
+// loopback LUN. The uevent watcher, if there is one, says as soon as it
+// appears; sysfs is checked every second as well, in case the uevent was
+// missed or came before the watcher was started.
+func (d *Device) findBlockDevice(ctx context.Context, w *ueventWatcher) error {
+	tgt, _ := d.getSCSIPrefixAndWnn()
+	b, err := d.fs.ReadFile(path.Join(tgt, "address"))
+	if err != nil {
+		return err
+	}
+	address := strings.TrimSpace(string(b))
+	glob := fmt.Sprintf("%s/%s:*/block/*/dev", scsiDevicesDir, address)
+
+	ctx, cancel := context.WithTimeout(ctx, devEntryTimeout)
+	defer cancel()
+	ticker := time.NewTicker(1 * time.Second)
+	defer ticker.Stop()
+
+	events := w.Events()
+	check := true
+	for {
+		if check {
+			dev, err := d.globBlockDevice(glob)
+			if err != nil {
+				return err
+			}
+			if dev != nil {
+				d.blockDev = dev
+				return nil
+			}
+			logrus.Debugf("Waiting for %s", glob)
+			check = false
+		}
+		select {
+		case u, ok := <-events:
+			if !ok {
+				events = nil
+				continue
+			}
+			if u.scsiDisk(address) {
+				d.blockDev = &blockDevice{name: u.DevName, major: u.Major, minor: u.Minor}
+				return nil
+			}
+		case <-ticker.C:
+			check = true
+		case <-ctx.Done():
+			return fmt.Errorf("Failed to find %s: %v", glob, ctx.Err())
+		}
+	}
+}
+
+// globBlockDevice looks for the disk in sysfs. It returns nil if it isn't
+// there yet.
+func (d *Device) globBlockDevice(glob string) (*blockDevice, error) {
+	matches, err := d.fs.Glob(glob)
+	if err != nil || len(matches) == 0 {
+		return nil, nil
+	}
+	if len(matches) > 1 {
+		return nil, fmt.Errorf("Too many matches for %s, found %d", glob, len(matches))
+	}
+
+	majorMinor, err := d.fs.ReadFile(matches[0])
+	if err != nil {
+		return nil, err
+	}
+	parts := strings.Split(strings.TrimSpace(string(majorMinor)), ":")
+	if len(parts) != 2 {
+		return nil, fmt.Errorf("Invalid major:minor string %s", string(majorMinor))
+	}
+	major, err := strconv.ParseUint(parts[0], 10, 32)
+	if err != nil {
+		return nil, err
+	}
+	minor, err := strconv.ParseUint(parts[1], 10, 32)
+	if err != nil {
+		return nil, err
+	}
+	return &blockDevice{
+		name:  path.Base(path.Dir(matches[0])),
+		major: uint32(major),
+		minor: uint32(minor),
+	}, nil
+}
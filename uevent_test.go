@@ -0,0 +1,181 @@
+package tcmu
+
+import (
+	"context"
+	"path"
+	"strings"
+	"testing"
+	"time"
+)
+
+const testDiskPath = "/devices/tcm_loop_0/tcm_loop_adapter_0/host3/target3:0:1/3:0:1:0/block/sdb"
+
+// ueventMsg builds a message as the kernel sends it: the header, then each
+// variable, all NUL-terminated.
+func ueventMsg(header string, env ...string) []byte {
+	return []byte(strings.Join(append([]string{header}, env...), "\x00") + "\x00")
+}
+
+// testDiskAdd is the event for sdb, as recorded from a loopback export.
+var testDiskAdd = ueventMsg("add@"+testDiskPath,
+	"ACTION=add",
+	"DEVPATH="+testDiskPath,
+	"SUBSYSTEM=block",
+	"MAJOR=8",
+	"MINOR=16",
+	"DEVNAME=sdb",
+	"DEVTYPE=disk",
+	"SEQNUM=4123",
+)
+
+func TestParseUevent(t *testing.T) {
+	u, err := parseUevent(testDiskAdd)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if u.Action != "add" || u.DevPath != testDiskPath || u.Subsystem != "block" ||
+		u.DevType != "disk" || u.DevName != "sdb" || u.Major != 8 || u.Minor != 16 {
+		t.Errorf("parsed %+v", u)
+	}
+	if u.Env["SEQNUM"] != "4123" {
+		t.Errorf("SEQNUM is %q", u.Env["SEQNUM"])
+	}
+	if !u.scsiDisk("3:0:1") {
+		t.Errorf("not the disk of 3:0:1")
+	}
+	for _, address := range []string{"3:0:10", "3:1:1", "4:0:1"} {
+		if u.scsiDisk(address) {
+			t.Errorf("taken for the disk of %s", address)
+		}
+	}
+}
+
+func TestParseUeventRejects(t *testing.T) {
+	for _, tt := range []struct {
+		name string
+		msg  []byte
+	}{
+		{"libudev", append([]byte("libudev\x00\xfe\xed\xca\xfe"), testDiskAdd...)},
+		{"no header", ueventMsg("ACTION=add", "DEVPATH="+testDiskPath)},
+		{"no action", ueventMsg("add@"+testDiskPath, "DEVPATH="+testDiskPath)},
+		{"no devpath", ueventMsg("add@"+testDiskPath, "ACTION=add")},
+		{"bad major", ueventMsg("add@"+testDiskPath, "ACTION=add", "DEVPATH="+testDiskPath, "MAJOR=sd")},
+		{"bad minor", ueventMsg("add@"+testDiskPath, "ACTION=add", "DEVPATH="+testDiskPath, "MINOR=-1")},
+		{"huge minor", ueventMsg("add@"+testDiskPath, "ACTION=add", "DEVPATH="+testDiskPath, "MINOR=4294967296")},
+		{"empty", nil},
+	} {
+		if u, err := parseUevent(tt.msg); err == nil {
+			t.Errorf("%s: parsed %+v", tt.name, u)
+		}
+	}
+}
+
+func TestParseUeventNoNumbers(t *testing.T) {
+	u, err := parseUevent(ueventMsg("change@"+testDiskPath,
+		"ACTION=change", "DEVPATH="+testDiskPath, "SUBSYSTEM=block", "junk"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if u.Major != 0 || u.Minor != 0 {
+		t.Errorf("got %d:%d for an event without numbers", u.Major, u.Minor)
+	}
+	if u.scsiDisk("3:0:1") {
+		t.Errorf("a change event taken for an added disk")
+	}
+}
+
+func TestUeventNotDisk(t *testing.T) {
+	for _, tt := range []struct {
+		name string
+		env  []string
+	}{
+		{"partition", []string{"SUBSYSTEM=block", "DEVTYPE=partition", "DEVNAME=sdb1"}},
+		{"scsi_device", []string{"SUBSYSTEM=scsi", "DEVTYPE=scsi_device"}},
+		{"no devname", []string{"SUBSYSTEM=block", "DEVTYPE=disk"}},
+	} {
+		env := append([]string{"ACTION=add", "DEVPATH=" + testDiskPath + "/sdb1"}, tt.env...)
+		u, err := parseUevent(ueventMsg("add@"+testDiskPath+"/sdb1", env...))
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		if u.scsiDisk("3:0:1") {
+			t.Errorf("%s taken for a disk", tt.name)
+		}
+	}
+}
+
+func TestFindBlockDeviceFromUevent(t *testing.T) {
+	fs := newFakeSysFS(t)
+	d := testDevice(fs)
+	tgt, _ := d.getSCSIPrefixAndWnn()
+	fs.file(t, path.Join(tgt, "address"), "3:0:1\n")
+
+	conn := newFakeNetlinkConn()
+	hub := &ueventHub{dial: func() (netlinkConn, error) { return conn, nil }}
+	w, err := hub.watch()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+	conn.recv <- []byte("libudev\x00junk")
+	conn.recv <- ueventMsg("add@/devices/virtual/block/loop0",
+		"ACTION=add", "DEVPATH=/devices/virtual/block/loop0", "SUBSYSTEM=block",
+		"DEVTYPE=disk", "DEVNAME=loop0", "MAJOR=7", "MINOR=0")
+	conn.recv <- testDiskAdd
+
+	if err := d.findBlockDevice(context.Background(), w); err != nil {
+		t.Fatal(err)
+	}
+	if p := d.BlockDevicePath(); p != "/dev/sdb" {
+		t.Errorf("found %s", p)
+	}
+	if major, minor := d.BlockDeviceNumber(); major != 8 || minor != 16 {
+		t.Errorf("found %d:%d", major, minor)
+	}
+}
+
+func TestUeventHubShared(t *testing.T) {
+	var dials int
+	conn := newFakeNetlinkConn()
+	hub := &ueventHub{dial: func() (netlinkConn, error) {
+		dials++
+		return conn, nil
+	}}
+	a, err := hub.watch()
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := hub.watch()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if dials != 1 {
+		t.Fatalf("dialed %d sockets for two watchers", dials)
+	}
+
+	conn.recv <- testDiskAdd
+	for _, w := range []*ueventWatcher{a, b} {
+		select {
+		case u := <-w.Events():
+			if u.DevName != "sdb" {
+				t.Errorf("got %+v", u)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("event not delivered")
+		}
+	}
+
+	a.Close()
+	select {
+	case <-conn.done:
+		t.Fatal("socket closed while b still watches")
+	default:
+	}
+	b.Close()
+	b.Close()
+	select {
+	case <-conn.done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("socket left open after the last watcher")
+	}
+}
@@ -0,0 +1,169 @@
+package tcmu
+
+import (
+	"io"
+	"os"
+	"syscall"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// iovMax is the most buffers one preadv or pwritev call takes.
+const iovMax = 1024
+
+// VectorReaderAt is implemented by backends that can read into several
+// buffers at once, as preadv(2) does. EmulateRead then reads straight into the
+// command's data area, rather than copying through Buf. Like ReadAt, ReadvAt
+// returns an error if it reads less than the buffers hold.
+type VectorReaderAt interface {
+	ReadvAt(bufs [][]byte, off int64) (n int, err error)
+}
+
+// VectorWriterAt is implemented by backends that can write from several
+// buffers at once, as pwritev(2) does. EmulateWrite then writes straight from
+// the command's data area. Like WriteAt, WritevAt returns an error if it writes
+// less than the buffers hold.
+type VectorWriterAt interface {
+	WritevAt(bufs [][]byte, off int64) (n int, err error)
+}
+
+// Iovecs returns the command's data buffers. They are the kernel's shared data
+// area itself, so reading or writing them involves no copy, but they must not
+// be used once the command has been responded to. Using them doesn't move the
+// position of Read and Write.
+func (c *SCSICmd) Iovecs() [][]byte {
+	return c.vecs
+}
+
+// iovecs returns the first n bytes of the command's data buffers.
+func (c *SCSICmd) iovecs(n int) [][]byte {
+	var out [][]byte
+	for _, v := range c.vecs {
+		if n == 0 {
+			break
+		}
+		if len(v) > n {
+			v = v[:n]
+		}
+		out = append(out, v)
+		n -= len(v)
+	}
+	return out
+}
+
+// vectorReader returns r as a VectorReaderAt, if it is one or is a file, and
+// nil otherwise.
+func vectorReader(r io.ReaderAt) VectorReaderAt {
+	switch r := r.(type) {
+	case VectorReaderAt:
+		return r
+	case *os.File:
+		return fileVectorIO{r}
+	}
+	return nil
+}
+
+// vectorWriter returns w as a VectorWriterAt, if it is one or is a file, and
+// nil otherwise.
+func vectorWriter(w io.WriterAt) VectorWriterAt {
+	switch w := w.(type) {
+	case VectorWriterAt:
+		return w
+	case *os.File:
+		return fileVectorIO{w}
+	}
+	return nil
+}
+
+// fileVectorIO does vectored I/O on a file with preadv and pwritev.
+type fileVectorIO struct {
+	f *os.File
+}
+
+func (f fileVectorIO) ReadvAt(bufs [][]byte, off int64) (int, error) {
+	return f.rwv(unix.SYS_PREADV, bufs, off)
+}
+
+func (f fileVectorIO) WritevAt(bufs [][]byte, off int64) (int, error) {
+	return f.rwv(unix.SYS_PWRITEV, bufs, off)
+}
+
+// rwv calls preadv or pwritev until bufs are done with, the file ends, or it
+// fails.
+func (f fileVectorIO) rwv(trap uintptr, bufs [][]byte, off int64) (int, error) {
+	rc, err := f.f.SyscallConn()
+	if err != nil {
+		return 0, err
+	}
+	total := 0
+	for len(bufs) > 0 {
+		iovs := make([]syscall.Iovec, 0, len(bufs))
+		for _, b := range bufs {
+			if len(iovs) == iovMax {
+				break
+			}
+			if len(b) == 0 {
+				continue
+			}
+			iov := syscall.Iovec{Base: &b[0]}
+			iov.SetLen(len(b))
+			iovs = append(iovs, iov)
+		}
+		if len(iovs) == 0 {
+			break
+		}
+
+		var n uintptr
+		var errno syscall.Errno
+		lo, hi := offsetLoHi(off)
+		cerr := rc.Control(func(fd uintptr) {
+			n, _, errno = unix.Syscall6(trap, fd, uintptr(unsafe.Pointer(&iovs[0])), uintptr(len(iovs)), lo, hi, 0)
+		})
+		if cerr != nil {
+			return total, cerr
+		}
+		if errno == unix.EINTR {
+			continue
+		}
+		if errno != 0 {
+			return total, &os.PathError{Op: trapName(trap), Path: f.f.Name(), Err: errno}
+		}
+		if n == 0 {
+			if trap == unix.SYS_PREADV {
+				return total, io.EOF
+			}
+			return total, io.ErrShortWrite
+		}
+		total += int(n)
+		off += int64(n)
+		bufs = skipBytes(bufs, int(n))
+	}
+	return total, nil
+}
+
+func trapName(trap uintptr) string {
+	if trap == unix.SYS_PREADV {
+		return "preadv"
+	}
+	return "pwritev"
+}
+
+// offsetLoHi splits a file offset into the two words preadv and pwritev take
+// it as; the high word is ignored on 64 bit.
+func offsetLoHi(off int64) (lo, hi uintptr) {
+	const longBits = unsafe.Sizeof(uintptr(0)) * 8
+	return uintptr(off), uintptr(uint64(off) >> (longBits - 1) >> 1)
+}
+
+// skipBytes drops the first n bytes from bufs.
+func skipBytes(bufs [][]byte, n int) [][]byte {
+	for len(bufs) > 0 && n >= len(bufs[0]) {
+		n -= len(bufs[0])
+		bufs = bufs[1:]
+	}
+	if len(bufs) > 0 {
+		bufs = append([][]byte{bufs[0][n:]}, bufs[1:]...)
+	}
+	return bufs
+}
@@ -0,0 +1,160 @@
+package tcmu
+
+import (
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// workerIdleTimeout is how long a worker beyond the pool's minimum waits for
+// a command before it exits.
+const workerIdleTimeout = 10 * time.Second
+
+// workerPool runs a handler's commands on a number of workers that grows
+// while commands queue up, and shrinks again when workers sit idle.
+type workerPool struct {
+	h        SCSICmdHandler
+	min, max int
+	in       chan *SCSICmd
+	out      chan SCSIResponse
+
+	mu      sync.Mutex
+	workers int
+	idle    int
+	closed  bool
+}
+
+// newWorkerPool returns a pool for h. A min of zero means one worker, and a
+// max of zero means depth.
+func newWorkerPool(h SCSICmdHandler, min, max, depth int) *workerPool {
+	if min <= 0 {
+		min = 1
+	}
+	if max <= 0 {
+		max = depth
+	}
+	if max < min {
+		max = min
+	}
+	return &workerPool{h: h, min: min, max: max}
+}
+
+// devReady starts the minimum number of workers.
+func (p *workerPool) devReady(in chan *SCSICmd, out chan SCSIResponse) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.in, p.out = in, out
+	for p.workers < p.min {
+		p.spawn()
+	}
+	return nil
+}
+
+// spawn starts a worker. p.mu must be held.
+func (p *workerPool) spawn() {
+	p.workers++
+	p.idle++
+	go p.work()
+}
+
+// grow starts another worker if there are more commands waiting than idle
+// workers to take them. It is called before each command is queued.
+func (p *workerPool) grow() {
+	if p == nil {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.in == nil || p.workers >= p.max || p.idle > len(p.in) {
+		return
+	}
+	p.spawn()
+}
+
+// size returns the number of workers.
+func (p *workerPool) size() int {
+	if p == nil {
+		return 0
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.workers
+}
+
+func (p *workerPool) work() {
+	ticker := time.NewTicker(workerIdleTimeout)
+	defer ticker.Stop()
+	last := time.Now()
+	for {
+		select {
+		case cmd, ok := <-p.in:
+			if !ok {
+				p.exit()
+				return
+			}
+			p.setIdle(false)
+			resp, err := p.h.HandleCommand(cmd)
+			if err != nil {
+				resp = cmd.Device().handlerFailed(cmd, err)
+			}
+			p.out <- resp
+			p.setIdle(true)
+			last = time.Now()
+		case <-ticker.C:
+			if time.Since(last) >= workerIdleTimeout && p.shrink() {
+				return
+			}
+		}
+	}
+}
+
+func (p *workerPool) setIdle(idle bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if idle {
+		p.idle++
+	} else {
+		p.idle--
+	}
+}
+
+// shrink lets an idle worker go, unless the pool is at its minimum.
+func (p *workerPool) shrink() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.workers <= p.min || p.closed {
+		return false
+	}
+	p.workers--
+	p.idle--
+	return true
+}
+
+// exit is called by a worker once the commands have run out. The last one out
+// closes the response channel.
+func (p *workerPool) exit() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.workers--
+	p.idle--
+	p.closed = true
+	if p.workers == 0 {
+		close(p.out)
+	}
+}
+
+// queueDepth returns the kernel's hw_queue_depth for the device, or the
+// default if it can't be read.
+func (d *Device) queueDepth() int {
+	b, err := d.fs.ReadFile(path.Join(d.hbaDir, d.scsi.VolumeName, "attrib", "hw_queue_depth"))
+	if err != nil {
+		return defaultQueueDepth
+	}
+	n, err := strconv.Atoi(strings.TrimSpace(string(b)))
+	if err != nil || n <= 0 {
+		return defaultQueueDepth
+	}
+	return n
+}